@@ -0,0 +1,253 @@
+package db
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HotKeys 找访问最多的 K 个 key, 用 HeavyKeeper:
+// depth 行 width 个桶, 每个桶记一个 key 的指纹和计数; 同一个 key 计数加一,
+// 别的 key 占着的桶按 Decay^count 的概率减一, 减到 0 就换成新 key, 冷 key 很难占住桶
+// 桶里的最大计数再和一个 K 个元素的小顶堆比较, 堆里就是当前的 top-K
+// 每 Interval 所有计数减半, 过气的热点会慢慢掉出去; 每 SampleRate 次 Add 只记一次
+// 当前的热点集合用 atomic.Value 发布, IsHot 和没被采样的 Add 只读快照不加锁, 集合变了才重建
+
+const (
+	__hotK        = 32
+	__hotWidth    = 1 << 10
+	__hotDepth    = 4
+	__hotDecay    = 0.9
+	__hotSample   = 8
+	__hotMinCount = 64
+	__hotInterval = time.Second * 10
+	__hotPow      = 256 //Decay^count 预先算好的个数, 更大的当作 0
+)
+
+type HotOptions struct {
+	K          int
+	Width      int
+	Depth      int
+	Decay      float64
+	SampleRate int
+	// 采样后的计数至少到多少才算热点
+	MinCount uint32
+	// 计数减半的间隔
+	Interval time.Duration
+}
+
+type HotKey struct {
+	Key   string
+	Count uint32
+}
+
+type hotBucket struct {
+	fp    uint64
+	count uint32
+}
+
+type hotHeap struct {
+	items []HotKey
+	index map[string]int
+}
+
+func (hh *hotHeap) Len() int           { return len(hh.items) }
+func (hh *hotHeap) Less(i, j int) bool { return hh.items[i].Count < hh.items[j].Count }
+func (hh *hotHeap) Swap(i, j int) {
+	hh.items[i], hh.items[j] = hh.items[j], hh.items[i]
+	hh.index[hh.items[i].Key] = i
+	hh.index[hh.items[j].Key] = j
+}
+func (hh *hotHeap) Push(x interface{}) {
+	item := x.(HotKey)
+	hh.index[item.Key] = len(hh.items)
+	hh.items = append(hh.items, item)
+}
+func (hh *hotHeap) Pop() interface{} {
+	item := hh.items[len(hh.items)-1]
+	hh.items = hh.items[:len(hh.items)-1]
+	delete(hh.index, item.Key)
+	return item
+}
+
+type HotKeys struct {
+	mu       sync.Mutex
+	buckets  []hotBucket
+	width    uint64
+	depth    int
+	pow      []float64
+	top      hotHeap
+	k        int
+	minCount uint32
+	sample   uint64
+	adds     uint64
+	rand     uint64
+	interval time.Duration
+	aged     time.Time
+	hot      atomic.Value //map[string]struct{}, 只读
+}
+
+func NewHotKeys(opts HotOptions) *HotKeys {
+
+	if opts.K <= 0 {
+		opts.K = __hotK
+	}
+	if opts.Width <= 0 {
+		opts.Width = __hotWidth
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = __hotDepth
+	}
+	if opts.Decay <= 0 || opts.Decay >= 1 {
+		opts.Decay = __hotDecay
+	}
+	if opts.SampleRate <= 0 {
+		opts.SampleRate = __hotSample
+	}
+	if opts.MinCount == 0 {
+		opts.MinCount = __hotMinCount
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = __hotInterval
+	}
+	width := 1
+	for width < opts.Width {
+		width <<= 1
+	}
+
+	hk := &HotKeys{
+		buckets:  make([]hotBucket, opts.Depth*width),
+		width:    uint64(width),
+		depth:    opts.Depth,
+		pow:      make([]float64, __hotPow),
+		top:      hotHeap{index: map[string]int{}},
+		k:        opts.K,
+		minCount: opts.MinCount,
+		sample:   uint64(opts.SampleRate),
+		rand:     uint64(time.Now().UnixNano()) | 1,
+		interval: opts.Interval,
+		aged:     time.Now(),
+	}
+	for i := range hk.pow {
+		hk.pow[i] = math.Pow(opts.Decay, float64(i))
+	}
+	hk.hot.Store(map[string]struct{}{})
+	return hk
+}
+
+// Add 记一次访问, 返回 key 现在是不是热点, 即在 top-K 里且达到 MinCount; 没被采样到时只查不记
+func (hk *HotKeys) Add(key string) bool {
+
+	if atomic.AddUint64(&hk.adds, 1)%hk.sample != 0 {
+		return hk.IsHot(key)
+	}
+	h := hash(key)
+
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	if time.Since(hk.aged) >= hk.interval {
+		hk._age()
+	}
+	count := uint32(0)
+	step := h>>32 | 1
+	for row := 0; row < hk.depth; row++ {
+		b := &hk.buckets[uint64(row)*hk.width+(h+uint64(row)*step)&(hk.width-1)]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = h, 1
+		case b.fp == h:
+			if b.count < math.MaxUint32 {
+				b.count++
+			}
+		case b.count < __hotPow && hk._random() < hk.pow[b.count]:
+			b.count--
+			if b.count == 0 {
+				b.fp, b.count = h, 1
+			}
+		}
+		if b.fp == h && b.count > count {
+			count = b.count
+		}
+	}
+
+	changed := false
+	if i, ok := hk.top.index[key]; ok {
+		hk.top.items[i].Count = count
+		heap.Fix(&hk.top, i)
+	} else if len(hk.top.items) < hk.k {
+		heap.Push(&hk.top, HotKey{Key: key, Count: count})
+	} else if count > hk.top.items[0].Count {
+		out := heap.Pop(&hk.top).(HotKey)
+		changed = out.Count >= hk.minCount
+		heap.Push(&hk.top, HotKey{Key: key, Count: count})
+	}
+	_, inTop := hk.top.index[key]
+	hot := inTop && count >= hk.minCount
+	if changed || hk.IsHot(key) != hot {
+		hk._publish()
+	}
+	return hot
+}
+
+// _publish 按堆重建热点快照, 持有 mu 时调用
+func (hk *HotKeys) _publish() {
+
+	hot := make(map[string]struct{}, len(hk.top.items))
+	for _, item := range hk.top.items {
+		if item.Count >= hk.minCount {
+			hot[item.Key] = struct{}{}
+		}
+	}
+	hk.hot.Store(hot)
+}
+
+// _random xorshift64, [0, 1)
+func (hk *HotKeys) _random() float64 {
+
+	hk.rand ^= hk.rand << 13
+	hk.rand ^= hk.rand >> 7
+	hk.rand ^= hk.rand << 17
+	return float64(hk.rand>>11) / (1 << 53)
+}
+
+// _age 所有计数减半, 减半不改变堆的顺序
+func (hk *HotKeys) _age() {
+
+	hk.aged = time.Now()
+	for i := range hk.buckets {
+		hk.buckets[i].count >>= 1
+	}
+	for i := range hk.top.items {
+		hk.top.items[i].Count >>= 1
+	}
+	hk._publish()
+}
+
+// IsHot 只读快照, 不加锁
+func (hk *HotKeys) IsHot(key string) bool {
+
+	_, ok := hk.hot.Load().(map[string]struct{})[key]
+	return ok
+}
+
+// Top 返回达到 MinCount 的热点, 按计数从大到小
+func (hk *HotKeys) Top() []HotKey {
+
+	hk.mu.Lock()
+	top := make([]HotKey, 0, len(hk.top.items))
+	for _, item := range hk.top.items {
+		if item.Count >= hk.minCount {
+			top = append(top, item)
+		}
+	}
+	hk.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Count > top[j].Count
+	})
+	return top
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"zcache/utils"
+)
+
+// 对象大小和 field 数的上限, 防止把几 MB 的文档写进 Redis 或 LMDB
+// 超出的写入返回 ErrTooLarge, 不写缓存; 计数在 expvar 的 zcache.oversize, 按 rdb.<table>/ldb.<table> 分开
+
+var ErrTooLarge = errors.New("db: object too large")
+
+var oversizeStats = expvar.NewMap("zcache.oversize")
+
+type Limit struct {
+	MaxBytes  int // 序列化后 field+value 的总字节数, 0 不限制
+	MaxFields int // 0 不限制
+}
+
+type Limits struct {
+	Limit
+	// 按 table 覆盖全局的 Limit
+	Tables map[string]Limit
+}
+
+// Enabled 是否配置了任何限制
+func (l *Limits) Enabled() bool {
+
+	return l.MaxBytes > 0 || l.MaxFields > 0 || len(l.Tables) > 0
+}
+
+// check kind 是 rdb 或 ldb, 只用于指标和日志
+func (l *Limits) check(kind, table, id string, fields, bytes int) error {
+
+	limit := l.Limit
+	if t, ok := l.Tables[table]; ok {
+		limit = t
+	}
+	if (limit.MaxBytes <= 0 || bytes <= limit.MaxBytes) && (limit.MaxFields <= 0 || fields <= limit.MaxFields) {
+		return nil
+	}
+	oversizeStats.Add(kind+"."+table, 1)
+	log.Println("oversize_err	", kind, table, id, fields, bytes)
+	return fmt.Errorf("%w: %s/%s %d fields %d bytes", ErrTooLarge, table, id, fields, bytes)
+}
+
+// _outSize 和写入 Redis, LMDB 时一样用 WriteArg 序列化
+func _outSize(out map[string]interface{}) int {
+
+	n := 0
+	for field, value := range out {
+		n += len(field) + len(utils.WriteArg(value))
+	}
+	return n
+}
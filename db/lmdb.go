@@ -2,112 +2,408 @@ package db
 
 import (
 	"fmt"
-	"strings"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 	"zcache/utils"
 
 	"github.com/bmatsuo/lmdb-go/lmdb"
-	"github.com/savsgio/gotils/strconv"
 )
 
 const (
-	__size       = 1024 * 1024 * 128 //128m
-	__maxDBs     = 16
-	__maxReaders = 1024 * __maxDBs
-	__flags      = lmdb.NoMetaSync | lmdb.NoSync | lmdb.MapAsync | lmdb.WriteMap
+	__size       = 1024 * 1024 * 128  //128m
+	__maxSize    = 1024 * 1024 * 1024 //1g
+	__maxDBs     = 256 //每个 table 一个 DBI, 另外 meta 占一个
+	__maxReaders = 1024 * 16
 	__mode       = 0600
 )
 
+type LdbOptions struct {
+	Size    int64 // 初始 map 大小
+	MaxSize int64 // MapFull 时自动扩容的上限
+	MaxDBs  int   // 每个 table 一个 DBI, 另外 meta 占一个, table 数超过时新 table 的 Set 失败
+
+	// 容量预算, 超出后按 Policy 整个对象淘汰, 都为 0 不淘汰
+	MaxBytes   int64
+	MaxEntries int64
+	Policy     EvictPolicy
+
+	// Set 默认的过期时间, 0 时与 Rdb 的 __expire 一致, <0 不过期
+	TTL time.Duration
+	// 后台清理过期对象的间隔和每个写事务最多检查的对象数
+	ReapInterval time.Duration
+	ReapBatch    int
+
+	// 只读打开 owner 进程的 env, 不写入, 不淘汰, 不清理过期
+	ReadOnly bool
+
+	// 默认 DurabilityVolatile, DurabilityPeriodic 每 SyncInterval 刷一次盘
+	Durability   LdbDurability
+	SyncInterval time.Duration
+
+	// 超出的 Set, SetEx 返回 ErrTooLarge
+	Limits Limits
+}
+
 type Ldb struct {
-	tmpDir  string
-	rootKey string
-	size    int64
-	env     *lmdb.Env
-	dbi     lmdb.DBI
+	tmpDir   string
+	rootKey  string
+	size     int64
+	maxSize  int64
+	resizes  int64
+	maxDBs   int
+	env      *lmdb.Env
+	metaDbi  lmdb.DBI
+	metaOpen bool
+
+	readOnly    bool
+	lastRefresh int64
+
+	durability   LdbDurability
+	syncInterval time.Duration
+
+	dbiMu sync.RWMutex
+	dbis  map[string]lmdb.DBI
+
+	// 所有事务持读锁, 扩容持写锁, 保证 SetMapSize 时本进程没有打开的事务
+	mu sync.RWMutex
+
+	maxBytes    int64
+	maxEntries  int64
+	policy      EvictPolicy
+	usedBytes   int64
+	usedEntries int64
+	evictions   int64
+	evicting    int32
+	evictHand   []byte
+
+	touchMu sync.Mutex
+	touches map[string]ldbTouch
+
+	ttl          time.Duration
+	reapInterval time.Duration
+	reapBatch    int
+	expired      int64
+	closed       chan struct{}
+	closeOnce    sync.Once
+
+	limits Limits
 }
 
 func NewLdb(rootKey, tmpDir string, size int64) *Ldb {
 
-	if size <= 0 {
-		size = __size
+	return NewLdbWithOptions(rootKey, tmpDir, LdbOptions{
+		Size: size,
+	})
+}
+
+func NewLdbWithOptions(rootKey, tmpDir string, opts LdbOptions) *Ldb {
+
+	if opts.Size <= 0 {
+		opts.Size = __size
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = __maxSize
+	}
+	if opts.MaxSize < opts.Size {
+		opts.MaxSize = opts.Size
+	}
+	if opts.MaxDBs <= 0 {
+		opts.MaxDBs = __maxDBs
+	}
+	if opts.Policy == nil && (opts.MaxBytes > 0 || opts.MaxEntries > 0) {
+		opts.Policy = LRUPolicy{}
+	}
+	if opts.ReadOnly {
+		opts.Policy = nil
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = __syncInterval
+	}
+	if opts.TTL == 0 {
+		opts.TTL = __expire
+	}
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = __reapInterval
+	}
+	if opts.ReapBatch <= 0 {
+		opts.ReapBatch = __reapBatch
 	}
 	ldb := &Ldb{
-		rootKey: rootKey,
-		tmpDir:  tmpDir,
-		size:    size,
+		rootKey:    rootKey,
+		tmpDir:     tmpDir,
+		size:       opts.Size,
+		maxSize:    opts.MaxSize,
+		maxDBs:     opts.MaxDBs,
+		dbis:       map[string]lmdb.DBI{},
+		maxBytes:   opts.MaxBytes,
+		maxEntries: opts.MaxEntries,
+		policy:     opts.Policy,
+		touches:    map[string]ldbTouch{},
+		limits:     opts.Limits,
+
+		ttl:          opts.TTL,
+		reapInterval: opts.ReapInterval,
+		reapBatch:    opts.ReapBatch,
+		closed:       make(chan struct{}),
+		readOnly:     opts.ReadOnly,
+		durability:   opts.Durability,
+		syncInterval: opts.SyncInterval,
 	}
 	ldb._init()
+	if !ldb.readOnly {
+		go ldb._reaper()
+	}
+	if !ldb.readOnly && ldb.durability == DurabilityPeriodic {
+		go ldb._syncer()
+	}
 	return ldb
 }
 
 func (ld *Ldb) _init() {
 
+	err := ld._open()
+	if err != nil && !ld.readOnly && _isCorrupt(err) {
+		// 缓存文件坏了就删掉重建, 不在启动时 panic
+		log.Println("ldb_corrupt	", ld.tmpDir, err)
+		err = ld._recreate()
+		if err == nil {
+			err = ld._open()
+		}
+	}
+	if err != nil {
+		panic("lmdb_init_err	" + err.Error())
+	}
+}
+
+func (ld *Ldb) _open() error {
+
 	var err error
 	ld.env, err = lmdb.NewEnv()
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
 	}
-	err = ld.env.SetMaxDBs(__maxDBs)
+	err = ld.env.SetMaxDBs(ld.maxDBs)
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
 	}
 	err = ld.env.SetMapSize(ld.size)
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
 	}
 	ld.env.SetMaxReaders(__maxReaders)
 
-	err = ld.env.Open(ld.tmpDir, __flags, __mode)
+	if ld.readOnly {
+		err = ld.env.Open(ld.tmpDir, ld.durability.flags()|lmdb.Readonly, __mode)
+		if err != nil {
+			return err
+		}
+		_, err = ld.ReaderCheck()
+		if err != nil {
+			return err
+		}
+		return ld._openShared()
+	}
+
+	err = ld.env.Open(ld.tmpDir, ld.durability.flags(), __mode)
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
 	}
 
 	err = ld.env.Sync(false)
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
+	}
+	_, err = ld.ReaderCheck()
+	if err != nil {
+		return err
 	}
 
 	err = ld.env.Update(func(txn *lmdb.Txn) error {
-		ld.dbi, err = txn.OpenDBI(ld.rootKey, lmdb.Create)
+		ld.metaDbi, err = txn.OpenDBI(ld.rootKey+__metaSuffix, lmdb.Create)
 		if err != nil {
 			return err
 		}
-		return nil
+		ld.metaOpen = true
+		// 旧版本所有 table 共用一个名为 rootKey 的 DBI, 缓存可以重建, 直接丢掉
+		legacy, err := txn.OpenDBI(ld.rootKey, 0)
+		if err == nil {
+			err = txn.Drop(legacy, true)
+			if err != nil {
+				return err
+			}
+			err = txn.Drop(ld.metaDbi, false)
+			if err != nil {
+				return err
+			}
+		} else if !lmdb.IsNotFound(err) {
+			return err
+		}
+		return ld._openTables(txn)
 	})
 	if err != nil {
-		panic("lmdb_init_err	" + err.Error())
+		return err
+	}
+
+	err = ld._check()
+	if err != nil {
+		return err
 	}
+	return ld._loadUsage()
 }
 
-func (ld *Ldb) GetAllKeys() [][]string {
+func (ld *Ldb) _view(fn lmdb.TxnOp) error {
 
-	allKeys := [][]string{}
-	ld.env.View(func(txn *lmdb.Txn) error {
+	ld.mu.RLock()
+	err := ld._txn(lmdb.Readonly, fn)
+	ld.mu.RUnlock()
+	if !lmdb.IsMapResized(err) {
+		return err
+	}
+	err = ld._adoptMapSize()
+	if err != nil {
+		return err
+	}
+	ld.mu.RLock()
+	defer ld.mu.RUnlock()
+	return ld._txn(lmdb.Readonly, fn)
+}
 
-		cursor, err := txn.OpenCursor(ld.dbi)
-		if err != nil {
-			return nil
+// _txn 调用方持有 mu 的读锁, Close 之后不再打开事务
+func (ld *Ldb) _txn(flags uint, fn lmdb.TxnOp) error {
+
+	select {
+	case <-ld.closed:
+		return ErrLdbClosed
+	default:
+	}
+	if flags&lmdb.Readonly != 0 {
+		return ld.env.View(fn)
+	}
+	return ld.env.Update(fn)
+}
+
+// _update 遇到 MapFull 时扩容后重试, fn 需要可重入
+func (ld *Ldb) _update(fn lmdb.TxnOp) error {
+
+	if ld.readOnly {
+		return ErrLdbReadOnly
+	}
+	for {
+		ld.mu.RLock()
+		size := ld.size
+		err := ld._txn(0, fn)
+		ld.mu.RUnlock()
+		if !lmdb.IsMapFull(err) {
+			return err
 		}
-		defer cursor.Close()
-		for {
-			k, _, err := cursor.Get(nil, nil, lmdb.Next)
-			if lmdb.IsNotFound(err) {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-			data := utils.BytesToString(k)
-			keys := strings.Split(data, "/")
-			allKeys = append(allKeys, []string{keys[0], keys[1]})
+		if !ld._grow(size) {
+			return err
 		}
+	}
+}
+
+// _write 在写事务里记录每个对象的字节变化, 提交后检查是否需要淘汰
+func (ld *Ldb) _write(fn func(txn *lmdb.Txn, acct *ldbAcct) error) error {
+
+	var acct *ldbAcct
+	err := ld._update(func(txn *lmdb.Txn) error {
+		acct = newLdbAcct()
+		err := fn(txn, acct)
+		if err != nil {
+			return err
+		}
+		return ld._commitAcct(txn, acct)
+	})
+	if err != nil {
+		return err
+	}
+	ld._addDbis(acct.dbis)
+	atomic.AddInt64(&ld.usedBytes, acct.bytes)
+	atomic.AddInt64(&ld.usedEntries, acct.entries)
+	ld._checkEvict()
+	return nil
+}
+
+func (ld *Ldb) _grow(size int64) bool {
+
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	if ld.size != size { //其他协程已经扩过了
+		return true
+	}
+	if ld.size >= ld.maxSize {
+		log.Println("ldb_map_full	", ld.rootKey, ld.size)
+		return false
+	}
+	newSize := ld.size * 2
+	if newSize > ld.maxSize {
+		newSize = ld.maxSize
+	}
+	err := ld.env.SetMapSize(newSize)
+	if err != nil {
+		log.Println("ldb_grow_err	", err)
+		return false
+	}
+	ld.size = newSize
+	atomic.AddInt64(&ld.resizes, 1)
+	return true
+}
+
+// Usage 返回已用字节数和当前 map 大小
+func (ld *Ldb) Usage() (used int64, size int64, err error) {
+
+	ld.mu.RLock()
+	defer ld.mu.RUnlock()
+
+	info, err := ld.env.Info()
+	if err != nil {
+		return 0, 0, err
+	}
+	stat, err := ld.env.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	used = (info.LastPNO + 1) * int64(stat.PSize)
+	return used, info.MapSize, nil
+}
+
+// Resizes 返回自动扩容的次数
+func (ld *Ldb) Resizes() int64 {
+
+	return atomic.LoadInt64(&ld.resizes)
+}
+
+func (ld *Ldb) GetAllKeys() [][]string {
+
+	allKeys := [][]string{}
+	for table := range ld._tableDbis() {
+		allKeys = append(allKeys, ld.GetTableKeys(table)...)
+	}
+	return allKeys
+}
+
+// GetTableKeys 只遍历一个 table 的 DBI, 返回 [key, field]
+func (ld *Ldb) GetTableKeys(table string) [][]string {
+
+	allKeys := [][]string{}
+	ld.Scan(ld._joinKey(table, ""), func(key, field string, v []byte) bool {
+		allKeys = append(allKeys, []string{key, field})
+		return true
 	})
 	return allKeys
 }
 
 func (ld *Ldb) _get(txn *lmdb.Txn, key, field string, value interface{}) (interface{}, error) {
 
-	tag := strconv.S2B(utils.Sprintf(key, "/", field))
-	bytes, err := txn.Get(ld.dbi, tag)
+	table, id := ld._splitKey(key)
+	dbi, err := ld._dbi(txn, nil, table, false)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := txn.Get(dbi, EncodeLdbKey(id, field))
 	if err != nil {
 		return nil, err
 	}
@@ -117,36 +413,131 @@ func (ld *Ldb) _get(txn *lmdb.Txn, key, field string, value interface{}) (interf
 	return utils.Scan(bytes, value)
 }
 
-func (ld *Ldb) _set(txn *lmdb.Txn, key, field string, value interface{}) error {
+func (ld *Ldb) _put(txn *lmdb.Txn, acct *ldbAcct, key string, tag, bytes []byte) error {
 
+	table, _ := ld._splitKey(key)
+	dbi, err := ld._dbi(txn, acct, table, true)
+	if err != nil {
+		return err
+	}
+	old, err := txn.Get(dbi, tag)
+	if err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	delta := int64(len(bytes) - len(old))
+	if err != nil {
+		delta += int64(len(tag))
+	}
+	err = txn.Put(dbi, tag, bytes, 0)
+	if err != nil {
+		return err
+	}
+	acct.add(key, delta)
+	return nil
+}
+
+func (ld *Ldb) _set(txn *lmdb.Txn, acct *ldbAcct, key, field string, value interface{}) error {
+
+	_, id := ld._splitKey(key)
 	bytes := utils.WriteArg(value)
-	tag := strconv.S2B(utils.Sprintf(key, "/", field))
-	return txn.Put(ld.dbi, tag, bytes, 0)
+	return ld._put(txn, acct, key, EncodeLdbKey(id, field), bytes)
 }
 
-func (ld *Ldb) _del(txn *lmdb.Txn, key, field string) error {
+func (ld *Ldb) _del(txn *lmdb.Txn, acct *ldbAcct, key, field string) error {
 
-	tag := strconv.S2B(utils.Sprintf(key, "/", field))
-	return txn.Del(ld.dbi, tag, nil)
+	table, id := ld._splitKey(key)
+	dbi, err := ld._dbi(txn, acct, table, false)
+	if err != nil {
+		return err
+	}
+	tag := EncodeLdbKey(id, field)
+	old, err := txn.Get(dbi, tag)
+	if err != nil {
+		return err
+	}
+	acct.add(key, -int64(len(tag)+len(old)))
+	return txn.Del(dbi, tag, nil)
+}
+
+// _delObject 删除对象的所有 field
+func (ld *Ldb) _delObject(txn *lmdb.Txn, acct *ldbAcct, key string) error {
+
+	acct.del(key)
+	table, id := ld._splitKey(key)
+	dbi, err := ld._dbi(txn, acct, table, false)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cursor, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	prefix := _objectPrefix(id)
+	return _seek(cursor, prefix, prefix, func(k, v []byte) (bool, error) {
+		return true, cursor.Del(0)
+	})
 }
 
 func (ld *Ldb) Set(key string, out map[string]interface{}) (err error) {
 
-	return ld.env.Update(func(txn *lmdb.Txn) error {
+	return ld.SetEx(key, out, ld.ttl)
+}
+
+// SetEx 写入对象并设置过期时间, ttl<=0 不过期
+func (ld *Ldb) SetEx(key string, out map[string]interface{}, ttl time.Duration) (err error) {
+
+	if ld.limits.Enabled() {
+		table, id := ld._splitKey(key)
+		err = ld.limits.check("ldb", table, id, len(out), _outSize(out))
+		if err != nil {
+			return err
+		}
+	}
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	return ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
 		for field, value := range out {
-			err := ld._set(txn, key, field, value)
+			err := ld._set(txn, acct, key, field, value)
 			if err != nil {
 				return err
 			}
 		}
+		acct.expire(key, expireAt)
 		return nil
 	})
 }
 
 func (ld *Ldb) Get(key string, info interface{}, out map[string]interface{}) error {
 
-	return ld.env.View(func(txn *lmdb.Txn) error {
-		txn.RawRead = true
+	err := ld._getObject(key, info, out)
+	if err != nil && ld.readOnly && lmdb.IsNotFound(err) && ld._refreshShared() {
+		err = ld._getObject(key, info, out)
+	}
+	if err != nil {
+		return err
+	}
+	ld._touch(key)
+	return nil
+}
+
+// string 和 []byte 会引用 mmap 的内存, 这里不用 RawRead, 事务结束后还要用
+func (ld *Ldb) _getObject(key string, info interface{}, out map[string]interface{}) error {
+
+	return ld._view(func(txn *lmdb.Txn) error {
+		meta, ok, err := ld._getMeta(txn, key)
+		if err != nil {
+			return err
+		}
+		if ok && meta.expired(time.Now().UnixNano()) {
+			return fmt.Errorf("expired")
+		}
 		for field, value := range out {
 			_value, _err := ld._get(txn, key, field, value)
 			if _err != nil {
@@ -158,86 +549,96 @@ func (ld *Ldb) Get(key string, info interface{}, out map[string]interface{}) err
 	})
 }
 
-func (ld *Ldb) MatchAllKeys(key string) [][]byte {
+// MatchAllKeys 返回 id 以 key 里的 id 开头的所有 [key, field]
+func (ld *Ldb) MatchAllKeys(key string) [][]string {
 
-	allKeys := [][]byte{}
-	ld.env.View(func(txn *lmdb.Txn) error {
-
-		cursor, err := txn.OpenCursor(ld.dbi)
-		if err != nil {
-			return nil
-		}
-		defer cursor.Close()
-		for {
-			k, _, err := cursor.Get(nil, nil, lmdb.Next)
-			if lmdb.IsNotFound(err) {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-			data := utils.BytesToString(k)
-			if strings.HasPrefix(data, key) {
-				allKeys = append(allKeys, k)
-			}
-		}
+	allKeys := [][]string{}
+	ld.Scan(key, func(key, field string, v []byte) bool {
+		allKeys = append(allKeys, []string{key, field})
+		return true
 	})
 	return allKeys
 }
 
 func (ld *Ldb) Del(key string, field string) (err error) {
 
-	if field != "" {
-		return ld.env.Update(func(txn *lmdb.Txn) error {
-			err := ld._del(txn, key, field)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-	}
-	allkeys := ld.MatchAllKeys(key)
-	return ld.env.Update(func(txn *lmdb.Txn) error {
-		for _, key := range allkeys {
-			err := txn.Del(ld.dbi, key, nil)
-			if err != nil {
-				return err
-			}
+	return ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+		if field != "" {
+			return ld._del(txn, acct, key, field)
 		}
-		return nil
+		return ld._delObject(txn, acct, key)
 	})
 }
 
-func (ld *Ldb) IncrBy(key, field string, incr int64) (ret int64, err error) {
+// IncrBy 在一个写事务里给 out 里所有数字 field 加上增量, 不存在的 field 从 0 开始
+// 整数 field 的旧值必须是整数, 浮点数 field 按 float64 加; 有一个失败整个事务回滚
+func (ld *Ldb) IncrBy(key string, out map[string]interface{}) (ret map[string]interface{}, err error) {
 
-	err = ld.env.Update(func(txn *lmdb.Txn) error {
-		_value, err := ld._get(txn, key, field, incr)
+	err = ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+		// 和 HINCRBY 一样不改已有对象的过期时间, 新建的对象按 Set 的默认 ttl 过期
+		_, exists, err := ld._getMeta(txn, key)
 		if err != nil {
 			return err
 		}
-		number, ok := utils.ToNumber(_value)
-		if !ok {
-			return fmt.Errorf("not number")
+		if !exists && ld.ttl > 0 {
+			acct.expire(key, time.Now().Add(ld.ttl).UnixNano())
 		}
-		number += incr
-		err = ld._set(txn, key, field, number)
-		if err != nil {
-			return err
+		ret = make(map[string]interface{}, len(out))
+		for field, incr := range out {
+			var number interface{}
+			if utils.IsFloat(incr) {
+				delta, _ := utils.ToFloat(incr)
+				old, err := ld._getNumber(txn, key, field, float64(0))
+				if err != nil {
+					return err
+				}
+				number = old.(float64) + delta
+			} else {
+				delta, ok := utils.ToNumber(incr)
+				if !ok {
+					continue
+				}
+				old, err := ld._getNumber(txn, key, field, int64(0))
+				if err != nil {
+					return err
+				}
+				number = old.(int64) + delta
+			}
+			err := ld._set(txn, acct, key, field, number)
+			if err != nil {
+				return err
+			}
+			ret[field] = number
 		}
-		ret = number
 		return nil
 	})
-	return ret, err
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// _getNumber field 不存在时返回 zero
+func (ld *Ldb) _getNumber(txn *lmdb.Txn, key, field string, zero interface{}) (interface{}, error) {
+
+	value, err := ld._get(txn, key, field, zero)
+	if lmdb.IsNotFound(err) {
+		return zero, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not number %s: %w", field, err)
+	}
+	return value, nil
 }
 
 func (ld *Ldb) Getset(key, field string, value interface{}) (ret interface{}, err error) {
 
-	err = ld.env.Update(func(txn *lmdb.Txn) error {
+	err = ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
 		ret, err = ld._get(txn, key, field, value)
 		if err != nil {
 			return err
 		}
-		err = ld._set(txn, key, field, value)
+		err = ld._set(txn, acct, key, field, value)
 		if err != nil {
 			return err
 		}
@@ -248,9 +649,9 @@ func (ld *Ldb) Getset(key, field string, value interface{}) (ret interface{}, er
 
 func (ld *Ldb) DelField(key string, out map[string]interface{}) (err error) {
 
-	err = ld.env.Update(func(txn *lmdb.Txn) error {
+	err = ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
 		for field := range out {
-			err := ld._del(txn, key, field)
+			err := ld._del(txn, acct, key, field)
 			if err != nil {
 				return err
 			}
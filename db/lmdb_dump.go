@@ -0,0 +1,280 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// dump format
+// magic(4) version(1) { 0x01 uvarint(tlen) table expires { uvarint(klen) key uvarint(vlen) value }... uvarint(0) }... 0x00
+// expires: { 0x01 uvarint(idlen) id uvarint(expireAt) }... 0x00, 只有设置了过期时间的对象
+// key 是 EncodeLdbKey 编码后的 id+field; lmdb key 不能为空, 所以 klen=0 做 table 的结束标记
+// 格式变化时加 version, 不认识的 version 直接报错
+
+const (
+	__dumpMagic   = "ZLDB"
+	__dumpVersion = 1
+	__dumpBatch   = 1024
+)
+
+// Export 把当前 rootKey 下的所有数据写成快照
+func (ld *Ldb) Export(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(__dumpMagic)
+	if err != nil {
+		return err
+	}
+	err = bw.WriteByte(__dumpVersion)
+	if err != nil {
+		return err
+	}
+
+	for table := range ld._tableDbis() {
+		err = bw.WriteByte(1)
+		if err != nil {
+			return err
+		}
+		err = writeDumpBytes(bw, []byte(table))
+		if err != nil {
+			return err
+		}
+		err = ld._exportTable(bw, table)
+		if err != nil {
+			return err
+		}
+		err = writeDumpBytes(bw, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = bw.WriteByte(0)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (ld *Ldb) _exportTable(bw *bufio.Writer, table string) error {
+
+	return ld._view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		dbi, err := ld._dbi(txn, nil, table, false)
+		if err != nil {
+			return err
+		}
+		err = ld._exportExpires(txn, bw, table)
+		if err != nil {
+			return err
+		}
+		cursor, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for {
+			k, v, err := cursor.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = writeDumpBytes(bw, k)
+			if err != nil {
+				return err
+			}
+			err = writeDumpBytes(bw, v)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// _exportExpires 和数据在同一个读事务里, 过期时间和数据一致
+func (ld *Ldb) _exportExpires(txn *lmdb.Txn, bw *bufio.Writer, table string) error {
+
+	metaDbi, ok := ld._meta()
+	if ok {
+		cursor, err := txn.OpenCursor(metaDbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		prefix := []byte(ld._joinKey(table, ""))
+		err = _seek(cursor, prefix, prefix, func(k, v []byte) (bool, error) {
+			meta := decodeLdbMeta(string(k), v)
+			if meta.ExpireAt <= 0 {
+				return true, nil
+			}
+			_, id := ld._splitKey(meta.Key)
+			err := bw.WriteByte(1)
+			if err != nil {
+				return false, err
+			}
+			err = writeDumpBytes(bw, []byte(id))
+			if err != nil {
+				return false, err
+			}
+			var buf [binary.MaxVarintLen64]byte
+			n := binary.PutUvarint(buf[:], uint64(meta.ExpireAt))
+			_, err = bw.Write(buf[:n])
+			return err == nil, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.WriteByte(0)
+}
+
+func readDumpExpires(br *bufio.Reader) (map[string]int64, error) {
+
+	expires := map[string]int64{}
+	for {
+		flag, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if flag == 0 {
+			return expires, nil
+		}
+		id, err := readDumpBytes(br)
+		if err != nil {
+			return nil, err
+		}
+		expireAt, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		expires[string(id)] = int64(expireAt)
+	}
+}
+
+// Import 读取 Export 的快照, 覆盖写入已有的 key
+func (ld *Ldb) Import(r io.Reader) error {
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(__dumpMagic)+1)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(__dumpMagic)]) != __dumpMagic {
+		return fmt.Errorf("ldb_import: bad magic")
+	}
+	version := header[len(__dumpMagic)]
+	if version != __dumpVersion {
+		return fmt.Errorf("ldb_import: unsupported version %d", version)
+	}
+
+	for {
+		flag, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if flag == 0 {
+			return nil
+		}
+		table, err := readDumpBytes(br)
+		if err != nil {
+			return err
+		}
+		expires, err := readDumpExpires(br)
+		if err != nil {
+			return err
+		}
+		err = ld._importTable(br, string(table), expires)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// _importTable 已经过期的对象不导入
+func (ld *Ldb) _importTable(br *bufio.Reader, table string, expires map[string]int64) error {
+
+	// 先把一批读进内存再写, _update 扩容重试时需要可重入
+	batch := make([][2][]byte, 0, __dumpBatch)
+	for {
+		batch = batch[:0]
+		done := false
+		for len(batch) < __dumpBatch {
+			k, err := readDumpBytes(br)
+			if err != nil {
+				return err
+			}
+			if len(k) == 0 {
+				done = true
+				break
+			}
+			v, err := readDumpBytes(br)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, [2][]byte{k, v})
+		}
+		now := time.Now().UnixNano()
+		err := ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+			for _, kv := range batch {
+				id, _, err := DecodeLdbKey(kv[0])
+				if err != nil {
+					return err
+				}
+				expireAt := expires[id]
+				if expireAt > 0 && expireAt <= now {
+					continue
+				}
+				key := ld._joinKey(table, id)
+				err = ld._put(txn, acct, key, kv[0], kv[1])
+				if err != nil {
+					return err
+				}
+				acct.expire(key, expireAt)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func writeDumpBytes(w *bufio.Writer, b []byte) error {
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	_, err := w.Write(buf[:n])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readDumpBytes(r *bufio.Reader) ([]byte, error) {
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
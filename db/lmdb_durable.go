@@ -0,0 +1,141 @@
+package db
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	__flags        = lmdb.NoMetaSync | lmdb.NoSync | lmdb.MapAsync | lmdb.WriteMap
+	__syncInterval = time.Second
+)
+
+// LdbDurability 决定 env 的刷盘策略
+type LdbDurability int
+
+const (
+	// DurabilityVolatile 不刷盘, 机器崩溃可能丢数据甚至损坏文件, 启动时检查
+	DurabilityVolatile LdbDurability = iota
+	// DurabilityPeriodic 提交不刷盘, 后台每 SyncInterval 强制刷一次
+	DurabilityPeriodic
+	// DurabilityDurable 每次提交都 fsync, 不用 WriteMap
+	DurabilityDurable
+)
+
+func (d LdbDurability) flags() uint {
+
+	switch d {
+	case DurabilityPeriodic:
+		return lmdb.NoMetaSync | lmdb.NoSync | lmdb.WriteMap
+	case DurabilityDurable:
+		return 0
+	default:
+		return __flags
+	}
+}
+
+func (d LdbDurability) String() string {
+
+	switch d {
+	case DurabilityPeriodic:
+		return "periodic-sync"
+	case DurabilityDurable:
+		return "durable"
+	default:
+		return "volatile"
+	}
+}
+
+func _isCorrupt(err error) bool {
+
+	return lmdb.IsErrno(err, lmdb.Corrupted) ||
+		lmdb.IsErrno(err, lmdb.PageNotFound) ||
+		lmdb.IsErrno(err, lmdb.Invalid) ||
+		lmdb.IsErrno(err, lmdb.VersionMismatch) ||
+		lmdb.IsErrno(err, lmdb.Panic)
+}
+
+// _check 用游标把 root/meta/table 的 B 树走一遍, 页号越界, 页类型不对这类结构损坏会返回 Corrupted 或 PageNotFound
+// lmdb 没有数据校验和, value 里的内容坏了查不出来; 坏页也可能让 C 代码直接崩溃, Go 里接不住
+func (ld *Ldb) _check() error {
+
+	dbis := []lmdb.DBI{ld.metaDbi}
+	for _, dbi := range ld.dbis {
+		dbis = append(dbis, dbi)
+	}
+	return ld.env.View(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		root, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		for _, dbi := range append(dbis, root) {
+			cursor, err := txn.OpenCursor(dbi)
+			if err != nil {
+				return err
+			}
+			err = _seek(cursor, nil, nil, func(k, v []byte) (bool, error) {
+				return true, nil
+			})
+			cursor.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// _recreate 关闭 env 并删掉数据文件和锁文件
+func (ld *Ldb) _recreate() error {
+
+	if ld.env != nil {
+		ld.env.Close()
+		ld.env = nil
+	}
+	ld.dbis = map[string]lmdb.DBI{}
+	ld.metaOpen = false
+
+	for _, name := range []string{"data.mdb", "lock.mdb"} {
+		err := os.Remove(filepath.Join(ld.tmpDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ld *Ldb) _syncer() {
+
+	ticker := time.NewTicker(ld.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ld.closed:
+			return
+		case <-ticker.C:
+		}
+		err := ld.Sync()
+		if err != nil && err != ErrLdbClosed {
+			log.Println("ldb_sync_err	", err)
+		}
+	}
+}
+
+// Sync 强制刷盘, 在 volatile 模式下退出前调用
+func (ld *Ldb) Sync() error {
+
+	ld.mu.RLock()
+	defer ld.mu.RUnlock()
+	select {
+	case <-ld.closed:
+		return ErrLdbClosed
+	default:
+	}
+	return ld.env.Sync(true)
+}
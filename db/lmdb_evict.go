@@ -0,0 +1,418 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	__metaSuffix    = "@meta"
+	__metaSize      = 32
+	__touchBatch    = 4096
+	__evictLowWater = 0.9 //淘汰到预算的 90%
+	__evictRounds   = 16
+	__sampleSize    = 64
+)
+
+// LdbMeta 每个对象 (rootKey/table/id) 一条, 存在 rootKey@meta 里
+type LdbMeta struct {
+	Key        string
+	LastAccess int64 // unix nano
+	Hits       uint64
+	Bytes      int64 // 对象所有 field 的 key+value 字节数
+	ExpireAt   int64 // unix nano, 0 不过期
+}
+
+func (m *LdbMeta) expired(now int64) bool {
+	return m.ExpireAt > 0 && now >= m.ExpireAt
+}
+
+func (m *LdbMeta) encode() []byte {
+
+	buf := make([]byte, __metaSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(m.LastAccess))
+	binary.LittleEndian.PutUint64(buf[8:], m.Hits)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(m.Bytes))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(m.ExpireAt))
+	return buf
+}
+
+func decodeLdbMeta(key string, buf []byte) *LdbMeta {
+
+	m := &LdbMeta{Key: key}
+	if len(buf) < 24 {
+		return m
+	}
+	m.LastAccess = int64(binary.LittleEndian.Uint64(buf[0:]))
+	m.Hits = binary.LittleEndian.Uint64(buf[8:])
+	m.Bytes = int64(binary.LittleEndian.Uint64(buf[16:]))
+	if len(buf) >= __metaSize { //旧的 24 字节记录没有过期时间
+		m.ExpireAt = int64(binary.LittleEndian.Uint64(buf[24:]))
+	}
+	return m
+}
+
+// EvictPolicy 决定超出预算时先淘汰哪些对象
+type EvictPolicy interface {
+	// Less 返回 a 是否应该比 b 先被淘汰
+	Less(a, b *LdbMeta) bool
+	// Sample 每轮检查的候选数, <=0 表示扫描全部对象
+	Sample() int
+}
+
+type LRUPolicy struct{}
+
+func (LRUPolicy) Less(a, b *LdbMeta) bool { return a.LastAccess < b.LastAccess }
+func (LRUPolicy) Sample() int             { return 0 }
+
+type LFUPolicy struct{}
+
+func (LFUPolicy) Less(a, b *LdbMeta) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.LastAccess < b.LastAccess
+}
+func (LFUPolicy) Sample() int { return 0 }
+
+// SampledLRUPolicy 近似 LRU, 每轮从一个轮转游标开始只看 N 个对象
+type SampledLRUPolicy struct {
+	N int
+}
+
+func (SampledLRUPolicy) Less(a, b *LdbMeta) bool { return a.LastAccess < b.LastAccess }
+func (p SampledLRUPolicy) Sample() int {
+	if p.N <= 0 {
+		return __sampleSize
+	}
+	return p.N
+}
+
+type ldbTouch struct {
+	at   int64
+	hits uint64
+}
+
+// ldbAcct 记录一个写事务里每个对象的字节变化, 提交时写回 meta
+type ldbAcct struct {
+	objs    map[string]int64
+	dels    map[string]struct{}
+	expires map[string]int64
+	dbis    map[string]lmdb.DBI
+	bytes   int64
+	entries int64
+}
+
+func newLdbAcct() *ldbAcct {
+
+	return &ldbAcct{
+		objs:    map[string]int64{},
+		dels:    map[string]struct{}{},
+		expires: map[string]int64{},
+		dbis:    map[string]lmdb.DBI{},
+	}
+}
+
+func (a *ldbAcct) add(key string, delta int64) {
+	a.objs[key] += delta
+}
+
+func (a *ldbAcct) expire(key string, expireAt int64) {
+	a.expires[key] = expireAt
+	if _, ok := a.objs[key]; !ok {
+		a.objs[key] = 0
+	}
+}
+
+func (a *ldbAcct) del(key string) {
+	a.dels[key] = struct{}{}
+	if _, ok := a.objs[key]; !ok {
+		a.objs[key] = 0
+	}
+}
+
+// _meta worker 进程里 meta 可能是后来才打开的
+func (ld *Ldb) _meta() (lmdb.DBI, bool) {
+
+	ld.dbiMu.RLock()
+	defer ld.dbiMu.RUnlock()
+	return ld.metaDbi, ld.metaOpen
+}
+
+func (ld *Ldb) _getMeta(txn *lmdb.Txn, key string) (*LdbMeta, bool, error) {
+
+	dbi, ok := ld._meta()
+	if !ok {
+		return &LdbMeta{Key: key}, false, nil
+	}
+	buf, err := txn.Get(dbi, []byte(key))
+	if lmdb.IsNotFound(err) {
+		return &LdbMeta{Key: key}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeLdbMeta(key, buf), true, nil
+}
+
+func (ld *Ldb) _commitAcct(txn *lmdb.Txn, acct *ldbAcct) error {
+
+	now := time.Now().UnixNano()
+	touches := ld._takeTouches()
+
+	for key, delta := range acct.objs {
+		meta, ok, err := ld._getMeta(txn, key)
+		if err != nil {
+			return err
+		}
+		old := meta.Bytes
+		meta.Bytes += delta
+		if t, ok := touches[key]; ok {
+			meta.Hits += t.hits
+			delete(touches, key)
+		}
+
+		_, deleted := acct.dels[key]
+		if deleted || meta.Bytes <= 0 {
+			if ok {
+				err = txn.Del(ld.metaDbi, []byte(key), nil)
+				if err != nil {
+					return err
+				}
+				acct.bytes -= old
+				acct.entries--
+			}
+			continue
+		}
+		if !ok {
+			acct.entries++
+		}
+		acct.bytes += meta.Bytes - old
+		meta.LastAccess = now
+		if expireAt, ok := acct.expires[key]; ok {
+			meta.ExpireAt = expireAt
+		}
+		err = txn.Put(ld.metaDbi, []byte(key), meta.encode(), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 只更新已存在的对象, 读到的 key 可能已经被删了
+	for key, t := range touches {
+		meta, ok, err := ld._getMeta(txn, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if t.at > meta.LastAccess {
+			meta.LastAccess = t.at
+		}
+		meta.Hits += t.hits
+		err = txn.Put(ld.metaDbi, []byte(key), meta.encode(), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ld *Ldb) _touch(key string) {
+
+	if ld.policy == nil {
+		return
+	}
+	ld.touchMu.Lock()
+	t := ld.touches[key]
+	t.at = time.Now().UnixNano()
+	t.hits++
+	ld.touches[key] = t
+	full := len(ld.touches) >= __touchBatch
+	ld.touchMu.Unlock()
+
+	if full {
+		ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+			return nil
+		})
+	}
+}
+
+func (ld *Ldb) _takeTouches() map[string]ldbTouch {
+
+	ld.touchMu.Lock()
+	defer ld.touchMu.Unlock()
+
+	touches := ld.touches
+	ld.touches = map[string]ldbTouch{}
+	return touches
+}
+
+func (ld *Ldb) _loadUsage() error {
+
+	dbi, ok := ld._meta()
+	if !ok {
+		return nil
+	}
+	var used, entries int64
+	err := ld._view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		cursor, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		for {
+			_, v, err := cursor.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			used += decodeLdbMeta("", v).Bytes
+			entries++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&ld.usedBytes, used)
+	atomic.StoreInt64(&ld.usedEntries, entries)
+	return nil
+}
+
+func (ld *Ldb) _overBudget(lowWater float64) bool {
+
+	if ld.maxBytes > 0 && float64(atomic.LoadInt64(&ld.usedBytes)) > float64(ld.maxBytes)*lowWater {
+		return true
+	}
+	if ld.maxEntries > 0 && float64(atomic.LoadInt64(&ld.usedEntries)) > float64(ld.maxEntries)*lowWater {
+		return true
+	}
+	return false
+}
+
+func (ld *Ldb) _checkEvict() {
+
+	if ld.policy == nil || !ld._overBudget(1) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ld.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ld.evicting, 0)
+
+	for i := 0; i < __evictRounds && ld._overBudget(__evictLowWater); i++ {
+		n, err := ld._evictRound()
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+func (ld *Ldb) _candidates() ([]*LdbMeta, error) {
+
+	sample := ld.policy.Sample()
+	metas := []*LdbMeta{}
+	err := ld._view(func(txn *lmdb.Txn) error {
+
+		cursor, err := txn.OpenCursor(ld.metaDbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		op := uint(lmdb.First)
+		if sample > 0 && len(ld.evictHand) > 0 {
+			op = lmdb.SetRange
+		}
+		k, v, err := cursor.Get(ld.evictHand, nil, op)
+		wrapped := op == lmdb.First
+		for {
+			if lmdb.IsNotFound(err) {
+				if wrapped || sample <= 0 {
+					return nil
+				}
+				wrapped = true
+				k, v, err = cursor.Get(nil, nil, lmdb.First)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if wrapped && op == lmdb.SetRange && bytes.Compare(k, ld.evictHand) >= 0 {
+				return nil
+			}
+			metas = append(metas, decodeLdbMeta(string(k), v))
+			if sample > 0 && len(metas) >= sample {
+				ld.evictHand = append(k[:len(k):len(k)], 0)
+				return nil
+			}
+			k, v, err = cursor.Get(nil, nil, lmdb.Next)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return ld.policy.Less(metas[i], metas[j])
+	})
+	return metas, nil
+}
+
+func (ld *Ldb) _evictRound() (int, error) {
+
+	metas, err := ld._candidates()
+	if err != nil {
+		return 0, err
+	}
+
+	lowBytes := float64(ld.maxBytes) * __evictLowWater
+	lowEntries := float64(ld.maxEntries) * __evictLowWater
+	n := 0
+	err = ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+		n = 0
+		used := atomic.LoadInt64(&ld.usedBytes)
+		entries := atomic.LoadInt64(&ld.usedEntries)
+		for _, meta := range metas {
+			over := (ld.maxBytes > 0 && float64(used) > lowBytes) ||
+				(ld.maxEntries > 0 && float64(entries) > lowEntries)
+			if !over {
+				return nil
+			}
+			err := ld._delObject(txn, acct, meta.Key)
+			if err != nil {
+				return err
+			}
+			used -= meta.Bytes
+			entries--
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&ld.evictions, int64(n))
+	return n, nil
+}
+
+// Evictions 返回因超出预算被淘汰的对象数
+func (ld *Ldb) Evictions() int64 {
+
+	return atomic.LoadInt64(&ld.evictions)
+}
+
+// UsedBytes 返回对象占用的字节数和对象个数
+func (ld *Ldb) UsedBytes() (bytes int64, entries int64) {
+
+	return atomic.LoadInt64(&ld.usedBytes), atomic.LoadInt64(&ld.usedEntries)
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	__iterBatch = 256
+)
+
+// _seek 用 SetRange 定位到 from, 遇到第一个不以 prefix 开头的 key 就停
+// fn 返回 false 提前结束, fn 里可以用 cursor.Del 删除当前 key
+func _seek(cursor *lmdb.Cursor, from, prefix []byte, fn func(k, v []byte) (bool, error)) error {
+
+	var k, v []byte
+	var err error
+	if len(from) == 0 {
+		k, v, err = cursor.Get(nil, nil, lmdb.First)
+	} else {
+		k, v, err = cursor.Get(from, nil, lmdb.SetRange)
+	}
+	for {
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		ok, ferr := fn(k, v)
+		if ferr != nil {
+			return ferr
+		}
+		if !ok {
+			return nil
+		}
+		k, v, err = cursor.Get(nil, nil, lmdb.Next)
+	}
+}
+
+// Scan 遍历 prefix (rootKey/table/id前缀) 匹配的所有 field
+// v 只在 fn 里有效, fn 返回 false 停止
+func (ld *Ldb) Scan(prefix string, fn func(key, field string, v []byte) bool) error {
+
+	table, id := ld._splitKey(prefix)
+	return ld._view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		dbi, err := ld._dbi(txn, nil, table, false)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cursor, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		tag := _escapeId(nil, id)
+		return _seek(cursor, tag, tag, func(k, v []byte) (bool, error) {
+			id, field, err := DecodeLdbKey(k)
+			if err != nil {
+				return false, err
+			}
+			return fn(ld._joinKey(table, id), field, v), nil
+		})
+	})
+}
+
+type ldbItem struct {
+	key   string
+	field string
+	value []byte
+}
+
+// LdbIter 遍历 [start, end) 的 key, 每次用一个短的读事务取一批,
+// 不长期占用 reader slot, 也不挡住扩容, 但不是一个一致的快照
+type LdbIter struct {
+	ld    *Ldb
+	table string
+	next  []byte
+	end   []byte
+	buf   []ldbItem
+	i     int
+	done  bool
+	err   error
+}
+
+// Range 返回 id 在 [start, end) 的迭代器, start 决定 table, end 的 id 为空遍历到 table 结束
+func (ld *Ldb) Range(start, end string) *LdbIter {
+
+	table, startId := ld._splitKey(start)
+	it := &LdbIter{
+		ld:    ld,
+		table: table,
+		next:  _escapeId(nil, startId),
+		i:     -1,
+	}
+	_, endId := ld._splitKey(end)
+	if endId != "" {
+		it.end = _escapeId(nil, endId)
+	}
+	return it
+}
+
+func (it *LdbIter) Next() bool {
+
+	if it.i+1 < len(it.buf) {
+		it.i++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	it.err = it._fetch()
+	if it.err != nil || len(it.buf) == 0 {
+		return false
+	}
+	it.i = 0
+	return true
+}
+
+func (it *LdbIter) _fetch() error {
+
+	it.buf = it.buf[:0]
+	it.i = -1
+	var last []byte
+	return it.ld._view(func(txn *lmdb.Txn) error {
+
+		dbi, err := it.ld._dbi(txn, nil, it.table, false)
+		if lmdb.IsNotFound(err) {
+			it.done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cursor, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		err = _seek(cursor, it.next, nil, func(k, v []byte) (bool, error) {
+			if len(it.end) > 0 && bytes.Compare(k, it.end) >= 0 {
+				return false, nil
+			}
+			id, field, err := DecodeLdbKey(k)
+			if err != nil {
+				return false, err
+			}
+			it.buf = append(it.buf, ldbItem{
+				key:   it.ld._joinKey(it.table, id),
+				field: field,
+				value: v,
+			})
+			last = k
+			return len(it.buf) < __iterBatch, nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(it.buf) < __iterBatch {
+			it.done = true
+			return nil
+		}
+		it.next = append(last[:len(last):len(last)], 0)
+		return nil
+	})
+}
+
+// Key 返回 rootKey/table/id
+func (it *LdbIter) Key() string {
+	return it.buf[it.i].key
+}
+
+func (it *LdbIter) Field() string {
+	return it.buf[it.i].field
+}
+
+func (it *LdbIter) Value() []byte {
+	return it.buf[it.i].value
+}
+
+func (it *LdbIter) Err() error {
+	return it.err
+}
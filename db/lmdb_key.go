@@ -0,0 +1,87 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"zcache/utils"
+)
+
+// table DBI 里的 key 编码:
+// id 里的 0x00 转义成 0x00 0xff, 以 0x00 0x01 结束, 后面直接跟 field
+// 转义后保持 id 的字典序, 也可以按 id 前缀做 SetRange
+// id 和 field 里可以有 '/' 或任意字节
+
+const (
+	__keyEsc = 0x00
+	__keyLit = 0xff
+	__keyEnd = 0x01
+)
+
+func _escapeId(dst []byte, id string) []byte {
+
+	for i := 0; i < len(id); i++ {
+		if id[i] == __keyEsc {
+			dst = append(dst, __keyEsc, __keyLit)
+			continue
+		}
+		dst = append(dst, id[i])
+	}
+	return dst
+}
+
+// EncodeLdbKey 把 id 和 field 编码成 table DBI 里的 key
+func EncodeLdbKey(id, field string) []byte {
+
+	buf := make([]byte, 0, len(id)+len(field)+2)
+	buf = _escapeId(buf, id)
+	buf = append(buf, __keyEsc, __keyEnd)
+	return append(buf, field...)
+}
+
+// DecodeLdbKey 是 EncodeLdbKey 的逆过程
+func DecodeLdbKey(b []byte) (id, field string, err error) {
+
+	buf := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != __keyEsc {
+			buf = append(buf, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		i++
+		switch b[i] {
+		case __keyLit:
+			buf = append(buf, __keyEsc)
+		case __keyEnd:
+			return string(buf), string(b[i+1:]), nil
+		default:
+			return "", "", fmt.Errorf("ldb_key: bad escape %x", b[i])
+		}
+	}
+	return "", "", fmt.Errorf("ldb_key: missing terminator")
+}
+
+// _objectPrefix 是对象所有 field 的公共前缀
+func _objectPrefix(id string) []byte {
+
+	buf := _escapeId(make([]byte, 0, len(id)+2), id)
+	return append(buf, __keyEsc, __keyEnd)
+}
+
+// _splitKey 把 rootKey/table/id 拆成 table 和 id, table 里没有 '/', id 可以有
+func (ld *Ldb) _splitKey(key string) (string, string) {
+
+	key = strings.TrimPrefix(key, ld.rootKey+"/")
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+func (ld *Ldb) _joinKey(table, id string) string {
+
+	return utils.Sprintf(ld.rootKey, "/", table, "/", id)
+}
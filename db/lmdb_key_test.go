@@ -0,0 +1,85 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+// TestLdbKey 编码可逆, 编码后的字节序和 (id, field) 的字典序一致, 对象前缀不会匹配到更长的 id
+func TestLdbKey(t *testing.T) {
+
+	ids := []string{
+		"",
+		"1",
+		"10",
+		"1/2",
+		"1/2/3",
+		"a",
+		"a\x00",
+		"a\x00b",
+		"a\x00\x01",
+		"a\x00\x01b",
+		"a\x00\xff",
+		"a\x01",
+		"a\xff",
+		"\x00",
+		"\x00\x00",
+		"\x00\x01",
+		"\xff",
+		"\xff\x00",
+	}
+	fields := []string{"", "name", "a/b", "\x00", "\x00\x01", "\xff"}
+
+	type pair struct {
+		id, field string
+		key       []byte
+	}
+	pairs := []pair{}
+	for _, id := range ids {
+		for _, field := range fields {
+			key := EncodeLdbKey(id, field)
+			gotId, gotField, err := DecodeLdbKey(key)
+			if err != nil || gotId != id || gotField != field {
+				t.Fatalf("decode %q %q: %q %q %v", id, field, gotId, gotField, err)
+			}
+			if !bytes.HasPrefix(key, _objectPrefix(id)) {
+				t.Fatalf("prefix %q: %q", id, key)
+			}
+			pairs = append(pairs, pair{id, field, key})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].id != pairs[j].id {
+			return pairs[i].id < pairs[j].id
+		}
+		return pairs[i].field < pairs[j].field
+	})
+	for i := 1; i < len(pairs); i++ {
+		a, b := pairs[i-1], pairs[i]
+		if bytes.Compare(a.key, b.key) >= 0 {
+			t.Fatalf("order (%q, %q) %q >= (%q, %q) %q", a.id, a.field, a.key, b.id, b.field, b.key)
+		}
+	}
+
+	// 只有同一个 id 的 key 有这个对象前缀
+	for _, id := range ids {
+		prefix := _objectPrefix(id)
+		for _, p := range pairs {
+			if bytes.HasPrefix(p.key, prefix) != (p.id == id) {
+				t.Fatalf("prefix %q matches id %q", id, p.id)
+			}
+		}
+	}
+	if bytes.HasPrefix(EncodeLdbKey("10", "name"), _objectPrefix("1")) {
+		t.Fatal(`prefix "1" matches id "10"`)
+	}
+
+	for _, key := range []string{"", "abc", "a\x00", "a\x00\x02b"} {
+		_, _, err := DecodeLdbKey([]byte(key))
+		if err == nil {
+			t.Fatalf("decode %q: no error", key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// 多进程共享:
+// 同一台机器上一个 owner 进程读写 env 并处理 Redis 的失效通知,
+// 其他 worker 进程用 ReadOnly 打开同一个目录, 只读 Get, 不订阅 Redis
+
+const (
+	__refreshInterval = time.Second
+)
+
+var ErrLdbReadOnly = errors.New("ldb: read only")
+
+// _openShared 只读打开 owner 已经创建的 DBI, owner 还没初始化时先跳过
+func (ld *Ldb) _openShared() error {
+
+	ld.dbiMu.Lock()
+	defer ld.dbiMu.Unlock()
+
+	return ld.env.View(func(txn *lmdb.Txn) error {
+		if !ld.metaOpen {
+			dbi, err := txn.OpenDBI(ld.rootKey+__metaSuffix, 0)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			ld.metaDbi = dbi
+			ld.metaOpen = true
+		}
+		return ld._openTables(txn)
+	})
+}
+
+// _refreshShared owner 新建了 table 后 worker 需要重新打开, 最多每秒一次
+func (ld *Ldb) _refreshShared() bool {
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&ld.lastRefresh)
+	if now-last < int64(__refreshInterval) {
+		return false
+	}
+	if !atomic.CompareAndSwapInt64(&ld.lastRefresh, last, now) {
+		return false
+	}
+	n := len(ld._tableDbis())
+	ld.mu.RLock()
+	err := ld._txn(lmdb.Readonly, func(txn *lmdb.Txn) error {
+		return nil
+	})
+	if err == nil {
+		err = ld._openShared()
+	}
+	ld.mu.RUnlock()
+	if err != nil {
+		return false
+	}
+	return len(ld._tableDbis()) != n
+}
+
+// _adoptMapSize owner 扩容后 worker 开事务会收到 MapResized, 用 0 采用文件里的大小
+func (ld *Ldb) _adoptMapSize() error {
+
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	err := ld.env.SetMapSize(0)
+	if err != nil {
+		return err
+	}
+	info, err := ld.env.Info()
+	if err != nil {
+		return err
+	}
+	ld.size = info.MapSize
+	return nil
+}
+
+// ReadOnly 是否是只读的 worker
+func (ld *Ldb) ReadOnly() bool {
+
+	return ld.readOnly
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// LdbDbiStats 一个 DBI 的 B 树统计
+type LdbDbiStats struct {
+	Entries       uint64
+	Depth         uint
+	BranchPages   uint64
+	LeafPages     uint64
+	OverflowPages uint64
+	Bytes         int64 // 所有页占的字节数
+}
+
+// LdbStats env 的整体情况, 由 Stats 返回
+type LdbStats struct {
+	PageSize  uint
+	MapSize   int64
+	MaxSize   int64
+	UsedBytes int64   // 已经用到的页 (含空闲页) 占的字节数
+	FillRatio float64 // UsedBytes / MapSize
+	Resizes   int64
+	LastTxnID int64
+
+	Readers    uint // 用过的 reader slot, 包括已经退出但没清理的进程
+	MaxReaders uint
+
+	Durability string
+	ReadOnly   bool
+
+	// meta 里记录的对象数和字节数
+	Objects     int64
+	ObjectBytes int64
+	Evictions   int64
+	Expired     int64
+
+	Meta   LdbDbiStats
+	Tables map[string]LdbDbiStats
+}
+
+func _dbiStats(stat *lmdb.Stat) LdbDbiStats {
+
+	pages := stat.BranchPages + stat.LeafPages + stat.OverflowPages
+	return LdbDbiStats{
+		Entries:       stat.Entries,
+		Depth:         stat.Depth,
+		BranchPages:   stat.BranchPages,
+		LeafPages:     stat.LeafPages,
+		OverflowPages: stat.OverflowPages,
+		Bytes:         int64(pages) * int64(stat.PSize),
+	}
+}
+
+// Stats 返回 env, meta 和每个 table 的统计
+func (ld *Ldb) Stats() (*LdbStats, error) {
+
+	stats := &LdbStats{
+		MaxSize:    ld.maxSize,
+		Resizes:    atomic.LoadInt64(&ld.resizes),
+		Durability: ld.durability.String(),
+		ReadOnly:   ld.readOnly,
+		Evictions:  atomic.LoadInt64(&ld.evictions),
+		Expired:    atomic.LoadInt64(&ld.expired),
+		Tables:     map[string]LdbDbiStats{},
+	}
+	stats.ObjectBytes, stats.Objects = ld.UsedBytes()
+
+	tables := ld._tableDbis()
+	err := ld._view(func(txn *lmdb.Txn) error {
+		info, err := ld.env.Info()
+		if err != nil {
+			return err
+		}
+		stat, err := ld.env.Stat()
+		if err != nil {
+			return err
+		}
+		stats.PageSize = stat.PSize
+		stats.MapSize = info.MapSize
+		stats.UsedBytes = (info.LastPNO + 1) * int64(stat.PSize)
+		if info.MapSize > 0 {
+			stats.FillRatio = float64(stats.UsedBytes) / float64(info.MapSize)
+		}
+		stats.LastTxnID = info.LastTxnID
+		stats.Readers = info.NumReaders
+		stats.MaxReaders = info.MaxReaders
+
+		if dbi, ok := ld._meta(); ok {
+			stat, err = txn.Stat(dbi)
+			if err != nil {
+				return err
+			}
+			stats.Meta = _dbiStats(stat)
+		}
+		for table, dbi := range tables {
+			stat, err = txn.Stat(dbi)
+			if err != nil {
+				return err
+			}
+			stats.Tables[table] = _dbiStats(stat)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ReaderCheck 清理已经退出的进程留下的 reader slot, 返回清理的个数
+// 进程崩溃时不会释放 slot, 积累到 MaxReaders 后新的读事务会失败
+func (ld *Ldb) ReaderCheck() (int, error) {
+
+	ld.mu.RLock()
+	defer ld.mu.RUnlock()
+
+	select {
+	case <-ld.closed:
+		return 0, ErrLdbClosed
+	default:
+	}
+	dead, err := ld.env.ReaderCheck()
+	if err != nil {
+		return 0, err
+	}
+	if dead > 0 {
+		log.Println("ldb_stale_readers	", ld.tmpDir, dead)
+	}
+	return dead, nil
+}
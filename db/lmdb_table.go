@@ -0,0 +1,143 @@
+package db
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"zcache/utils"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// 每个 table 一个 DBI, 名字是 rootKey/table
+// key 的格式是 rootKey/table/id
+
+func (ld *Ldb) _dbiName(table string) string {
+
+	return utils.Sprintf(ld.rootKey, "/", table)
+}
+
+// _dbi 返回 table 的 DBI, create 时在写事务里懒创建, 提交后才放进 dbis
+func (ld *Ldb) _dbi(txn *lmdb.Txn, acct *ldbAcct, table string, create bool) (lmdb.DBI, error) {
+
+	ld.dbiMu.RLock()
+	dbi, ok := ld.dbis[table]
+	ld.dbiMu.RUnlock()
+	if ok {
+		return dbi, nil
+	}
+	if acct != nil {
+		dbi, ok = acct.dbis[table]
+		if ok {
+			return dbi, nil
+		}
+	}
+	if !create || acct == nil {
+		return 0, lmdb.NotFound
+	}
+	dbi, err := txn.OpenDBI(ld._dbiName(table), lmdb.Create)
+	if err != nil {
+		log.Println("ldb_dbi_err	", ld.rootKey, table, err) //DbsFull 时要调大 MaxDBs
+		return 0, err
+	}
+	acct.dbis[table] = dbi
+	return dbi, nil
+}
+
+func (ld *Ldb) _addDbis(dbis map[string]lmdb.DBI) {
+
+	if len(dbis) == 0 {
+		return
+	}
+	ld.dbiMu.Lock()
+	defer ld.dbiMu.Unlock()
+	for table, dbi := range dbis {
+		ld.dbis[table] = dbi
+	}
+}
+
+// _openTables 打开 root DBI 里已有的 rootKey/*
+func (ld *Ldb) _openTables(txn *lmdb.Txn) error {
+
+	root, err := txn.OpenRoot(0)
+	if err != nil {
+		return err
+	}
+	cursor, err := txn.OpenCursor(root)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	prefix := ld.rootKey + "/"
+	names := []string{}
+	err = _seek(cursor, []byte(prefix), []byte(prefix), func(k, v []byte) (bool, error) {
+		names = append(names, string(k))
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		dbi, err := txn.OpenDBI(name, 0)
+		if err != nil {
+			return err
+		}
+		ld.dbis[strings.TrimPrefix(name, prefix)] = dbi
+	}
+	return nil
+}
+
+func (ld *Ldb) _tableDbis() map[string]lmdb.DBI {
+
+	ld.dbiMu.RLock()
+	defer ld.dbiMu.RUnlock()
+
+	dbis := make(map[string]lmdb.DBI, len(ld.dbis))
+	for table, dbi := range ld.dbis {
+		dbis[table] = dbi
+	}
+	return dbis
+}
+
+// Tables 返回已经创建过 DBI 的 table
+func (ld *Ldb) Tables() []string {
+
+	tables := []string{}
+	for table := range ld._tableDbis() {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// FlushTable 清空一个 table 的数据和 meta, 不影响其他 table
+func (ld *Ldb) FlushTable(table string) error {
+
+	return ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+		dbi, err := ld._dbi(txn, acct, table, false)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = txn.Drop(dbi, false)
+		if err != nil {
+			return err
+		}
+
+		cursor, err := txn.OpenCursor(ld.metaDbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		prefix := []byte(utils.Sprintf(ld.rootKey, "/", table, "/"))
+		return _seek(cursor, prefix, prefix, func(k, v []byte) (bool, error) {
+			acct.del(string(k))
+			return true, nil
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	__reapInterval = time.Minute
+	__reapBatch    = 256
+)
+
+var ErrLdbClosed = errors.New("ldb: closed")
+
+// Close 停止后台清理并关闭 env
+func (ld *Ldb) Close() error {
+
+	err := ErrLdbClosed
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	ld.closeOnce.Do(func() {
+		close(ld.closed)
+		err = ld.env.Close()
+	})
+	return err
+}
+
+// Expired 返回被后台清理掉的过期对象数
+func (ld *Ldb) Expired() int64 {
+
+	return atomic.LoadInt64(&ld.expired)
+}
+
+func (ld *Ldb) _reaper() {
+
+	ticker := time.NewTicker(ld.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ld.closed:
+			return
+		case <-ticker.C:
+		}
+		_, err := ld.ReaderCheck()
+		if err != nil {
+			log.Println("ldb_reader_check_err	", err)
+		}
+		err = ld.Reap()
+		if err != nil {
+			log.Println("ldb_reap_err	", err)
+		}
+	}
+}
+
+// Reap 从头到尾扫一遍 meta, 每个写事务最多检查 reapBatch 个对象
+func (ld *Ldb) Reap() error {
+
+	var hand []byte
+	for {
+		select {
+		case <-ld.closed:
+			return nil
+		default:
+		}
+		var done bool
+		var err error
+		hand, done, err = ld._reapBatch(hand)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (ld *Ldb) _reapBatch(start []byte) ([]byte, bool, error) {
+
+	var (
+		done bool
+		hand []byte
+		n    int64
+	)
+	err := ld._write(func(txn *lmdb.Txn, acct *ldbAcct) error {
+		done, hand, n = false, start, 0
+
+		cursor, err := txn.OpenCursor(ld.metaDbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		op := uint(lmdb.First)
+		if len(start) > 0 {
+			op = lmdb.SetRange
+		}
+		now := time.Now().UnixNano()
+		k, v, err := cursor.Get(start, nil, op)
+		for i := 0; i < ld.reapBatch; i++ {
+			if lmdb.IsNotFound(err) {
+				done = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			meta := decodeLdbMeta(string(k), v)
+			if meta.expired(now) {
+				err = ld._delObject(txn, acct, meta.Key)
+				if err != nil {
+					return err
+				}
+				n++
+			}
+			hand = append(k[:len(k):len(k)], 0)
+			k, v, err = cursor.Get(nil, nil, lmdb.Next)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	atomic.AddInt64(&ld.expired, n)
+	return hand, done, nil
+}
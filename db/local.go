@@ -1,205 +1,216 @@
 package db
 
 import (
+	"log"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+// Local 进程内的 key/value 表, 可以并发使用
+// 按 key 的 hash 分到 N 个分片, 每个分片一把锁, 一张 Robin Hood 表和一个 slab, 见 localShard
+
 const (
-	__total     = (1 << 4) - 1
-	__chunkSize = 8
-	__chunkLen  = 2
-	__lenSize   = 2
+	__localShards = 16
 )
 
-type Local struct {
-	chunk     []byte
-	indexs    []byte //1k
-	chunkSize int
-	chunkLen  int
-	total     int
-	lenSize   int
-	//threadLocal map[uint64][]byte
+type LocalOptions struct {
+	// slab 最多 mmap 的字节数, 平分给每个分片, 分片到达后开始淘汰
+	// 按 arena(1m) 分配, 不足一个 arena 时按一个 arena 算
+	MaxBytes int64
+	// 分片数, 向上取 2 的幂; 每个分片至少一个 arena, MaxBytes 不够时减少分片数
+	Shards int
+	// Get 不加锁, 用 seqlock 读, 读不挡写; 写很频繁时读会重试
+	SeqlockReads bool
+
+	// 对象最多保留多久, SetEx 的 ttl 超过时按 MaxStale 算, 0 不限制
+	MaxStale time.Duration
+	// 后台清理过期对象的间隔和每个分片每次最多检查的槽数
+	SweepInterval time.Duration
+	SweepBatch    int
 }
 
-//node
-//1024byte=1kb
-//max 4m
-
-// k=4b
-// v=1024b
-// value max length = 4k
-
-// TODO 后续加入idle索引每个空chunk, index索引用了那些chunk,做个最高上线
-// TODO 先分配一个 4k page, 然后把4k page, 拆分成 8bytes, 16bytes的 slab
+type Local struct {
+	shards  []*localShard
+	mask    uint64
+	seqlock bool
+	closed  int32
+	done    chan struct{}
+
+	maxStale      time.Duration
+	sweepInterval time.Duration
+	sweepBatch    int
+}
 
 func NewLocal() *Local {
 
-	chunk := make([]byte, __total*__chunkSize*__chunkLen)
-	indexs := make([]byte, __total*__chunkSize*1)
-
-	return &Local{
-		chunk:     chunk,
-		indexs:    indexs,
-		chunkSize: __chunkSize,
-		chunkLen:  __chunkLen,
-		total:     __total,
-		lenSize:   __lenSize,
-	}
-}
-
-func hash(key string) int {
-	hash := 0
-	for i := 0; i < len(key); i++ {
-		hash = 31*hash + int(key[i])
-	}
-	return hash
+	return NewLocalWithOptions(LocalOptions{})
 }
 
-func (l *Local) existsKey(key string) (int, bool) {
+func NewLocalWithOptions(opts LocalOptions) *Local {
 
-	klen := len(key)
-	if klen+l.lenSize > l.chunkSize {
-		return 0, false
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = __localMaxBytes
 	}
+	if opts.Shards <= 0 {
+		opts.Shards = __localShards
+	}
+	n := 1
+	for n < opts.Shards {
+		n <<= 1
+	}
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = __sweepInterval
+	}
+	if opts.SweepBatch <= 0 {
+		opts.SweepBatch = __sweepBatch
+	}
+	if opts.MaxBytes < __arenaSize {
+		log.Println("local_max_bytes	", opts.MaxBytes, __arenaSize)
+		opts.MaxBytes = __arenaSize
+	}
+	for n > 1 && opts.MaxBytes/int64(n) < __arenaSize {
+		n >>= 1
+	}
+	maxBytes := opts.MaxBytes / int64(n)
 
-	offset := hash(key) % l.total
-	thatKlen := bytes2int(l.indexs, offset)
-
-	keyStart := offset*l.chunkSize + l.lenSize
-	keyEnd := keyStart + klen
-	thatKey := BytesToString(l.indexs[keyStart:keyEnd])
+	l := &Local{
+		shards:  make([]*localShard, n),
+		mask:    uint64(n - 1),
+		seqlock: opts.SeqlockReads,
+		done:    make(chan struct{}),
 
-	//fmt.Println(thatKey, thatKlen, keyStart, keyEnd)
-	if thatKlen != 0 && thatKey != key { //已有了, 不做冲突处理
-		return 0, false
+		maxStale:      opts.MaxStale,
+		sweepInterval: opts.SweepInterval,
+		sweepBatch:    opts.SweepBatch,
+	}
+	for i := range l.shards {
+		l.shards[i] = newLocalShard(maxBytes)
 	}
-	return offset, true
+	go l._sweeper()
+	return l
 }
 
-func int2bytes(bytes []byte, offset, v int) {
-	bytes[offset] = byte((v >> 8) & 0xff) //高位
-	offset++
-	bytes[offset] = byte(v & 0xff) //低位
-}
+// hash FNV-1a, 不分配内存
+func hash(key string) uint64 {
 
-func bytes2int(bytes []byte, offset int) int {
-	height := int(bytes[offset]) << 8 //高位
-	offset++
-	low := int(bytes[offset]) //低位
-	v := height + low
-	return v
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
 }
 
-type callback = func(start, end, chunkStart, chunkEnd int)
-
-func (l *Local) next(offset, vlen int, cb callback) {
-
-	start := 0
-	end := l.chunkSize - l.lenSize
-	chunkStart := offset*l.chunkSize + l.lenSize
-	chunkEnd := (offset + 1) * l.chunkSize
+// _shard 用 hash 的高位选分片, 低位留给分片里的表
+func (l *Local) _shard(h uint64) *localShard {
 
-	//fmt.Println(start, end, 1111)
-	//fmt.Println(chuankStart, chuankEnd, 2222)
+	return l.shards[(h>>32)&l.mask]
+}
 
-	for i := 0; i < l.chunkLen; i++ {
+// Set 分片内存满了先按 CLOCK 淘汰, 新 key 没有被淘汰的 key 热时不写入, 也不返回错误
+// 找不到同一级 chunk 可以淘汰时返回 ErrLocalFull, 原来的 value 保留
+func (l *Local) Set(key string, value []byte) error {
 
-		if start >= vlen {
-			break
-		}
-		if start < vlen && end >= vlen {
-			end = vlen
-		}
+	return l.SetEx(key, value, 0)
+}
 
-		//fmt.Println("vlen", start, end, value[start:end])
-		//fmt.Println("chunk", chuankStart, chuankEnd, l.chunk[chuankStart:chuankEnd])
-		//copy(l.chunk[chunkStart:chunkEnd], value[start:end])
-		cb(start, end, chunkStart, chunkEnd)
+// SetEx ttl 到期后 Get 不再返回, ttl<=0 时只受 MaxStale 限制
+func (l *Local) SetEx(key string, value []byte, ttl time.Duration) error {
 
-		start = end
-		end = start + l.chunkSize
-		chunkStart = chunkEnd
-		chunkEnd = chunkStart + l.chunkSize
+	if l.maxStale > 0 && (ttl <= 0 || ttl > l.maxStale) {
+		ttl = l.maxStale
 	}
+	exp := int64(0)
+	if ttl > 0 {
+		exp = time.Now().Add(ttl).UnixNano()
+	}
+	h := hash(key)
+	return l._shard(h).set(h, key, value, exp)
 }
 
-func (l *Local) Set(key string, value []byte) {
-	//gid := l.getGid()
+// AppendValue 把 value 追加到 dst 后返回, dst 容量够时不分配内存
+func (l *Local) AppendValue(dst []byte, key string) ([]byte, bool) {
 
-	offset, ok := l.existsKey(key)
-	if !ok {
-		return
+	if atomic.LoadInt32(&l.closed) == 1 {
+		return dst, false
 	}
-	//fmt.Println("key", offset, ok)
-
-	vlen := len(value)
-	if vlen+2 > l.chunkLen*l.chunkSize {
-		return
+	h := hash(key)
+	shard := l._shard(h)
+	if l.seqlock {
+		return shard.readSeq(dst, h, key)
 	}
-
-	klen := len(key)
-	int2bytes(l.indexs, offset*l.chunkSize, klen)
-	l.next(offset, klen, func(start, end, chunkStart, chunkEnd int) {
-		copy(l.indexs[chunkStart:chunkEnd], key[start:end])
-	})
-
-	int2bytes(l.chunk, offset*l.chunkSize, vlen)
-
-	// fmt.Println("vlen", offset*l.chunkLen, offset)
-	// fmt.Println("v", l.chunk)
-
-	l.next(offset, vlen, func(start, end, chunkStart, chunkEnd int) {
-		//fmt.Println("get value", start, end)
-		//fmt.Println("set chunk", chunkStart, chunkEnd)
-		copy(l.chunk[chunkStart:chunkEnd], value[start:end])
-	})
-
+	shard.sketch.increment(h)
+	return shard.read(dst, h, key)
 }
 
+// Get 返回 value 的拷贝, 不存在返回 nil
 func (l *Local) Get(key string) []byte {
-	//gid := l.getGid()
 
-	offset, ok := l.existsKey(key)
+	v, ok := l.AppendValue(nil, key)
 	if !ok {
 		return nil
 	}
-	//fmt.Println(offset, ok)
-	vlen := 0
-	vlen = bytes2int(l.chunk, offset*l.chunkSize)
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
 
-	//fmt.Println(vlen)
+func (l *Local) Del(key string) {
 
-	value := make([]byte, vlen)
+	h := hash(key)
+	l._shard(h).del(h, key)
+}
 
-	l.next(offset, vlen, func(start, end, chunkStart, chunkEnd int) {
-		//fmt.Println("set value", start, end)
-		//fmt.Println("get chunk", chunkStart, chunkEnd)
-		copy(value[start:end], l.chunk[chunkStart:chunkEnd])
-	})
+// Len 返回对象个数
+func (l *Local) Len() int {
 
-	return value
+	return l.Stats().Entries
 }
 
-func (l *Local) Del(key string) {
-	offset, ok := l.existsKey(key)
-	if !ok {
-		return
-	}
-	//fmt.Println(offset, ok)
-	vlen := 0
-	vlen = bytes2int(l.chunk, offset*l.chunkSize)
+type LocalStats struct {
+	Entries     int
+	Slots       int   //当前表和扩容中旧表的槽数
+	MappedBytes int64 //mmap 的 arena 总大小
+	ChunkBytes  int64 //已分配 chunk 的字节数
+	Evictions   int64 //为了腾地方淘汰的对象数
+	Rejected    int64 //TinyLFU 拒绝写入的次数
+	Expired     int64 //清理掉的过期对象数
+}
 
-	int2bytes(l.chunk, offset, 0)
+func (l *Local) Stats() LocalStats {
+
+	stats := LocalStats{}
+	for _, shard := range l.shards {
+		s := shard.stats()
+		stats.Entries += s.Entries
+		stats.Slots += s.Slots
+		stats.MappedBytes += s.MappedBytes
+		stats.ChunkBytes += s.ChunkBytes
+		stats.Evictions += s.Evictions
+		stats.Rejected += s.Rejected
+		stats.Expired += s.Expired
+	}
+	return stats
+}
 
-	//fmt.Println(vlen)
+// Close 释放所有 arena, 之后 Get 都返回不存在
+// seqlock 读不持锁, 调用方要保证 Close 时没有正在进行的 Get
+func (l *Local) Close() error {
 
-	l.next(offset, vlen, func(start, end, chunkStart, chunkEnd int) {
-		//fmt.Println("set value", start, end)
-		//fmt.Println("get chunk", chunkStart, chunkEnd)
-		for i := chunkStart; i < chunkStart; i++ {
-			l.chunk[chunkStart] = 0
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return ErrLocalClosed
+	}
+	close(l.done)
+	var err error
+	for _, shard := range l.shards {
+		e := shard.close()
+		if e != nil {
+			err = e
 		}
-	})
+	}
+	return err
 }
 
 // BytesToString converts byte slice to string.
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// 分片的 slab 满了以后按 CLOCK 淘汰, 用 TinyLFU 决定新 key 能不能挤掉被淘汰的 key
+// CLOCK: 每个槽一个访问位, Get 命中时置位; 淘汰时手从上次停下的地方往后扫,
+// 访问位为 1 的清掉继续, 为 0 的就是候选. 只看和新对象同一级 chunk 的槽, 别的级释放了也用不上
+// TinyLFU: count-min sketch 记录每个 key 最近的访问次数, 4 行 4 位计数器,
+// 总次数到 10 倍宽度时所有计数器减半, 旧的热点会慢慢冷下去
+// 同一级找不到 victim 时 (slab 被别的大小占满), 按页整块淘汰, 把页还给空闲页池, 见 _reclaim
+
+const (
+	__sketchDepth    = 4
+	__sketchMin      = 1 << 10
+	__sketchMax      = 1 << 20
+	__sketchPerKey   = 128 //按每个对象 128 字节估算分片能放多少 key
+	__sketchSamples  = 10
+	__evictTries     = 8   //一次 Set 最多淘汰几次
+	__victimSteps    = 256 //找同一级的 victim 最多看几个槽
+	__reclaimSamples = 4   //整块淘汰时比较几个候选块
+)
+
+// localSketch 计数器 4 位一个, 8 个放在一个 uint32 里, 读写都是原子操作, 读不用持锁
+type localSketch struct {
+	counters []uint32
+	width    uint64 //每行的计数器个数, 2 的幂
+	adds     uint32
+	samples  uint32
+}
+
+func newLocalSketch(maxBytes int64) *localSketch {
+
+	width := uint64(__sketchMin)
+	for width < __sketchMax && int64(width)*__sketchPerKey < maxBytes {
+		width <<= 1
+	}
+	return &localSketch{
+		counters: make([]uint32, __sketchDepth*width/8),
+		width:    width,
+		samples:  uint32(width * __sketchSamples),
+	}
+}
+
+// _index 第 row 行计数器的位置, 用 h 的高低两半做双重 hash
+func (sk *localSketch) _index(h uint64, row int) uint64 {
+
+	step := h>>32 | 1
+	return uint64(row)*sk.width + (h+uint64(row)*step)&(sk.width-1)
+}
+
+func (sk *localSketch) increment(h uint64) {
+
+	for row := 0; row < __sketchDepth; row++ {
+		idx := sk._index(h, row)
+		word := &sk.counters[idx/8]
+		shift := (idx % 8) * 4
+		for {
+			old := atomic.LoadUint32(word)
+			if (old>>shift)&0xf == 0xf {
+				break
+			}
+			if atomic.CompareAndSwapUint32(word, old, old+1<<shift) {
+				break
+			}
+		}
+	}
+	if atomic.AddUint32(&sk.adds, 1)%sk.samples == 0 {
+		sk._age()
+	}
+}
+
+// _age 所有计数器减半
+func (sk *localSketch) _age() {
+
+	for i := range sk.counters {
+		for {
+			old := atomic.LoadUint32(&sk.counters[i])
+			if atomic.CompareAndSwapUint32(&sk.counters[i], old, (old>>1)&0x77777777) {
+				break
+			}
+		}
+	}
+}
+
+func (sk *localSketch) estimate(h uint64) uint32 {
+
+	min := uint32(0xf)
+	for row := 0; row < __sketchDepth; row++ {
+		idx := sk._index(h, row)
+		n := (atomic.LoadUint32(&sk.counters[idx/8]) >> ((idx % 8) * 4)) & 0xf
+		if n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// _victim 从 clock 开始找 c 级的一个访问位为 0 的槽, 最多看 __victimSteps 个槽
+func (s *localShard) _victim(c uint8) (*localTable, uint64, bool) {
+
+	cur, old := s._tables()
+	steps := 0
+	if old != nil {
+		for i := s.hand; i < uint64(len(old.cells)) && steps < __victimSteps; i, steps = i+1, steps+1 { //旧表 hand 之前都是空的
+			slot := old.cells[i].load()
+			if slot.dist != 0 && slot.class == c {
+				return old, i, true
+			}
+		}
+	}
+	for ; steps < __victimSteps; steps++ {
+		i := s.clock & cur.mask
+		s.clock++
+		slot := cur.cells[i].load()
+		if slot.dist == 0 || slot.class != c {
+			continue
+		}
+		if slot.used {
+			cur.cells[i].clear()
+			continue
+		}
+		return cur, i, true
+	}
+	return nil, 0, false
+}
+
+// _alloc slab 满了就淘汰同一级的对象腾地方, 同一级找不到就整块淘汰别的级的页, 新 key 不如被淘汰的热就不放进来
+func (s *localShard) _alloc(h uint64, n int, resident bool) (uint8, localRef, bool, error) {
+
+	for try := 0; ; try++ {
+		c, ref, err := s.slab.alloc(n)
+		if err != ErrLocalFull || try >= __evictTries {
+			return c, ref, true, err
+		}
+		c, _ = _chunkClass(n)
+		t, i, ok := s._victim(c)
+		if !ok {
+			if !s._reclaim(h, c, resident) {
+				s.rejected++
+				return 0, 0, false, nil
+			}
+			continue
+		}
+		victim := t.cells[i].load()
+		if victim.expired(time.Now().UnixNano()) { //过期的直接腾出来, 不用比热度
+			s._remove(t, i)
+			s.expired++
+			continue
+		}
+		if !resident && s.sketch.estimate(h) <= s.sketch.estimate(victim.hash) {
+			s.rejected++
+			return 0, 0, false, nil
+		}
+		s._remove(t, i)
+		s.evictions++
+	}
+}
+
+// _reclaim 从 pageHand 开始看 __reclaimSamples 个和 c 级 span 一样大的对齐块, 选平均热度最低的,
+// 淘汰块里所有对象, 空出来的 span 回到空闲页池后和 buddy 合并, c 级就能用了
+// 新 key 比块里对象的平均热度低时不淘汰, 返回 false
+func (s *localShard) _reclaim(h uint64, c uint8, resident bool) bool {
+
+	pages := s.slab.pages()
+	order := _spanOrder(c)
+	size := int32(1) << order
+	if pages < size {
+		return true
+	}
+	best, bestSum, bestLen := int32(-1), uint64(0), 0
+	for sample := 0; sample < __reclaimSamples; sample++ {
+		b := s.pageHand % pages &^ (size - 1)
+		s.pageHand = (b + size) % pages
+		s.victims = s.slab.block(b, order, s.victims[:0])
+		if len(s.victims) == 0 {
+			continue
+		}
+		sum := uint64(0)
+		for _, ref := range s.victims {
+			sum += uint64(s.sketch.estimate(binary.LittleEndian.Uint64(s.slab.bytes(ref, __chunkHdr))))
+		}
+		if best < 0 || sum*uint64(bestLen) < bestSum*uint64(len(s.victims)) {
+			best, bestSum, bestLen = b, sum, len(s.victims)
+		}
+	}
+	if best < 0 {
+		return true
+	}
+	if !resident && uint64(s.sketch.estimate(h))*uint64(bestLen) < bestSum {
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	s.victims = s.slab.block(best, order, s.victims[:0])
+	for _, ref := range s.victims {
+		t, i, ok := s._findRef(binary.LittleEndian.Uint64(s.slab.bytes(ref, __chunkHdr)), ref)
+		if !ok {
+			continue
+		}
+		slot := t.cells[i].load()
+		if slot.expired(now) {
+			s.expired++
+		} else {
+			s.evictions++
+		}
+		s._remove(t, i)
+	}
+	return true
+}
+
+// _findRef 按 hash 找指向 ref 的槽
+func (s *localShard) _findRef(h uint64, ref localRef) (*localTable, uint64, bool) {
+
+	cur, old := s._tables()
+	for _, t := range [2]*localTable{cur, old} {
+		if t == nil {
+			continue
+		}
+		i := h & t.mask
+		for d := uint32(1); ; d++ {
+			slot := t.cells[i].load()
+			if slot.dist < d {
+				break
+			}
+			if slot.ref == ref {
+				return t, i, true
+			}
+			i = (i + 1) & t.mask
+		}
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,349 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// ShmLocal 同一台机器上多个进程共享的 key/value 表, 放在 /dev/shm 的文件里
+// 文件开头是定长的 header, 后面是定长的槽, 槽数和每个槽的数据区大小创建时就定下来, 不扩容
+// 写: 进程内用 mu, 进程间用 flock 互斥; 读: 不加锁, 每个槽一个 seqlock, 读到写了一半的数据就重试
+// 找不到空槽时覆盖 key 理想位置的槽, 是个只保留热点 key 的缓存
+
+const (
+	__shmDir      = "/dev/shm"
+	__shmMagic    = "ZSHM"
+	__shmVersion  = 1
+	__shmHeader   = 64
+	__shmSlots    = 1 << 16
+	__shmDataSize = 256 //每个槽 key+value 的最大长度
+	__shmProbe    = 8   //最多向后找几个槽
+	__shmRetries  = 64
+
+	__shmTomb = 1 << 63 //lens 的最高位, 槽被删除过
+)
+
+var ErrShmVersion = errors.New("shm: header mismatch")
+
+type ShmOptions struct {
+	Dir      string //默认 /dev/shm
+	Slots    int    //向上取 2 的幂
+	DataSize int
+}
+
+// header: magic[4] version[4] slots[8] dataSize[8]
+// 槽: seq[8] hash[8] lens[8]=klen<<32|vlen data[dataSize]
+type ShmLocal struct {
+	path     string
+	file     *os.File
+	mem      []byte
+	slots    uint64
+	mask     uint64
+	dataSize int
+	slotSize int
+	mu       sync.Mutex
+	closed   int32
+}
+
+func NewShmLocal(name string, opts ShmOptions) *ShmLocal {
+
+	if opts.Dir == "" {
+		opts.Dir = __shmDir
+	}
+	if opts.Slots <= 0 {
+		opts.Slots = __shmSlots
+	}
+	if opts.DataSize <= 0 {
+		opts.DataSize = __shmDataSize
+	}
+	n := 1
+	for n < opts.Slots {
+		n <<= 1
+	}
+	sl := &ShmLocal{
+		path:     filepath.Join(opts.Dir, name+".zshm"),
+		slots:    uint64(n),
+		mask:     uint64(n - 1),
+		dataSize: opts.DataSize,
+		slotSize: 24 + (opts.DataSize+7)&^7,
+	}
+	err := sl._init()
+	if err != nil {
+		panic("shm_init_err	" + err.Error())
+	}
+	return sl
+}
+
+// _init 第一个进程创建并写 header, 之后的进程检查 header 和自己的参数一致
+func (sl *ShmLocal) _init() error {
+
+	var err error
+	sl.file, err = os.OpenFile(sl.path, os.O_RDWR|os.O_CREATE, __mode)
+	if err != nil {
+		return err
+	}
+	fd := int(sl.file.Fd())
+	err = syscall.Flock(fd, syscall.LOCK_EX)
+	if err != nil {
+		sl.file.Close()
+		return err
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	size := __shmHeader + int64(sl.slots)*int64(sl.slotSize)
+	info, err := sl.file.Stat()
+	if err != nil {
+		sl.file.Close()
+		return err
+	}
+	fresh := info.Size() == 0
+	if fresh {
+		err = sl.file.Truncate(size)
+		if err != nil {
+			sl.file.Close()
+			return err
+		}
+	} else if info.Size() != size {
+		sl.file.Close()
+		return ErrShmVersion
+	}
+
+	sl.mem, err = syscall.Mmap(fd, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		sl.file.Close()
+		return err
+	}
+	header := sl.mem[:__shmHeader]
+	if string(header[:4]) != __shmMagic && binary.LittleEndian.Uint32(header[4:]) == 0 {
+		fresh = true //创建的进程在写 header 之前退出了
+	}
+	if fresh {
+		binary.LittleEndian.PutUint32(header[4:], __shmVersion)
+		binary.LittleEndian.PutUint64(header[8:], sl.slots)
+		binary.LittleEndian.PutUint64(header[16:], uint64(sl.dataSize))
+		copy(header, __shmMagic) //magic 最后写, 有 magic 就说明 header 完整
+		return nil
+	}
+	if string(header[:4]) != __shmMagic ||
+		binary.LittleEndian.Uint32(header[4:]) != __shmVersion ||
+		binary.LittleEndian.Uint64(header[8:]) != sl.slots ||
+		binary.LittleEndian.Uint64(header[16:]) != uint64(sl.dataSize) {
+		sl.Close()
+		return ErrShmVersion
+	}
+	return nil
+}
+
+func (sl *ShmLocal) _word(i uint64, off int) *uint64 {
+
+	return (*uint64)(unsafe.Pointer(&sl.mem[__shmHeader+int(i)*sl.slotSize+off]))
+}
+
+func (sl *ShmLocal) _data(i uint64, n int) []byte {
+
+	start := __shmHeader + int(i)*sl.slotSize + 24
+	return sl.mem[start : start+n]
+}
+
+func _shmHash(key string) uint64 {
+
+	h := hash(key)
+	if h == 0 { //0 表示空槽
+		h = 1
+	}
+	return h
+}
+
+// _lock 进程内和进程间都互斥
+func (sl *ShmLocal) _lock() (func(), error) {
+
+	sl.mu.Lock()
+	if atomic.LoadInt32(&sl.closed) == 1 {
+		sl.mu.Unlock()
+		return nil, ErrLocalClosed
+	}
+	fd := int(sl.file.Fd())
+	err := syscall.Flock(fd, syscall.LOCK_EX)
+	if err != nil {
+		sl.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(fd, syscall.LOCK_UN)
+		sl.mu.Unlock()
+	}, nil
+}
+
+// _write 改槽前后各改一次 seq, 上一个写的进程崩溃留下的奇数 seq 也会被修正
+func (sl *ShmLocal) _write(i uint64, fn func()) {
+
+	seq := sl._word(i, 0)
+	s := atomic.LoadUint64(seq) | 1
+	atomic.StoreUint64(seq, s)
+	fn()
+	atomic.StoreUint64(seq, s+1)
+}
+
+func (sl *ShmLocal) Set(key string, value []byte) error {
+
+	n := len(key) + len(value)
+	if n > sl.dataSize {
+		return ErrLocalTooLarge
+	}
+	unlock, err := sl._lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	h := _shmHash(key)
+	target := h & sl.mask
+	free := int64(-1)
+	for p := uint64(0); p < __shmProbe; p++ {
+		i := (h + p) & sl.mask
+		sh := atomic.LoadUint64(sl._word(i, 8))
+		lens := atomic.LoadUint64(sl._word(i, 16))
+		if sh == h && lens&__shmTomb == 0 && int(lens>>32) == len(key) && BytesToString(sl._data(i, len(key))) == key {
+			free = int64(i)
+			break
+		}
+		if free < 0 && (sh == 0 || lens&__shmTomb != 0) {
+			free = int64(i)
+		}
+		if sh == 0 { //空槽后面不会再有这个 key
+			break
+		}
+	}
+	if free >= 0 {
+		target = uint64(free)
+	}
+
+	sl._write(target, func() {
+		copy(sl._data(target, n), key)
+		copy(sl._data(target, n)[len(key):], value)
+		atomic.StoreUint64(sl._word(target, 8), h)
+		atomic.StoreUint64(sl._word(target, 16), uint64(len(key))<<32|uint64(len(value)))
+	})
+	return nil
+}
+
+// AppendValue 不加锁读, 一直读到写了一半的槽就当作不存在
+func (sl *ShmLocal) AppendValue(dst []byte, key string) ([]byte, bool) {
+
+	if atomic.LoadInt32(&sl.closed) == 1 {
+		return dst, false
+	}
+	h := _shmHash(key)
+	for p := uint64(0); p < __shmProbe; p++ {
+		i := (h + p) & sl.mask
+		out, found, empty := sl._read(dst, i, h, key)
+		if found || empty {
+			return out, found
+		}
+	}
+	return dst, false
+}
+
+func (sl *ShmLocal) _read(dst []byte, i, h uint64, key string) ([]byte, bool, bool) {
+
+	n := len(dst)
+	for retry := 0; retry < __shmRetries; retry++ {
+		seq := atomic.LoadUint64(sl._word(i, 0))
+		if seq&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		sh := atomic.LoadUint64(sl._word(i, 8))
+		lens := atomic.LoadUint64(sl._word(i, 16))
+		klen, vlen := int(lens>>32&0x7fffffff), int(uint32(lens))
+		if sh != h || lens&__shmTomb != 0 || klen != len(key) || klen+vlen > sl.dataSize {
+			if atomic.LoadUint64(sl._word(i, 0)) == seq {
+				return dst[:n], false, sh == 0
+			}
+			continue
+		}
+		data := sl._data(i, klen+vlen)
+		match := BytesToString(data[:klen]) == key
+		out := dst[:n]
+		if match {
+			out = append(out, data[klen:]...)
+		}
+		if atomic.LoadUint64(sl._word(i, 0)) == seq {
+			if match {
+				return out, true, false
+			}
+			return dst[:n], false, false
+		}
+	}
+	return dst[:n], false, true
+}
+
+// Get 返回 value 的拷贝, 不存在返回 nil
+func (sl *ShmLocal) Get(key string) []byte {
+
+	v, ok := sl.AppendValue(nil, key)
+	if !ok {
+		return nil
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+// Del 留下墓碑, 不打断后面槽的查找
+func (sl *ShmLocal) Del(key string) {
+
+	unlock, err := sl._lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	h := _shmHash(key)
+	for p := uint64(0); p < __shmProbe; p++ {
+		i := (h + p) & sl.mask
+		sh := atomic.LoadUint64(sl._word(i, 8))
+		if sh == 0 {
+			return
+		}
+		lens := atomic.LoadUint64(sl._word(i, 16))
+		if sh == h && lens&__shmTomb == 0 && int(lens>>32) == len(key) && BytesToString(sl._data(i, len(key))) == key {
+			sl._write(i, func() {
+				atomic.StoreUint64(sl._word(i, 16), __shmTomb)
+			})
+			return
+		}
+	}
+}
+
+// Close 只解除映射, 文件留给其他进程, 调用方要保证 Close 时没有正在进行的 Get
+func (sl *ShmLocal) Close() error {
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&sl.closed, 0, 1) {
+		return ErrLocalClosed
+	}
+	err := syscall.Munmap(sl.mem)
+	sl.mem = nil
+	e := sl.file.Close()
+	if err == nil {
+		err = e
+	}
+	return err
+}
+
+// Remove 删除共享文件, 已经打开的进程不受影响
+func (sl *ShmLocal) Remove() error {
+
+	return os.Remove(sl.path)
+}
@@ -0,0 +1,379 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Local 的 key 和 value 存在 slab 里, 不在 Go 堆上, GC 不用扫描
+// 每次 mmap 一个 arena, arena 按 buddy 方式切成 2^order 个 4k page 的 span, span 按自己的大小对齐
+// 一个 span 只切一种大小的 chunk, chunk 按 8, 16, 32 ... 分级, 每个 span 一个空闲链表, next 直接写在空闲 chunk 里
+// 有空闲 chunk 的 span 挂在所属级别的 partial 链表上; span 里的 chunk 全部释放后整个 span 还给空闲页池,
+// 和相邻的空闲 buddy 合并, 之后任何一级都可以用, 不会永久属于某一级
+
+const (
+	__pageSize      = 4096
+	__arenaSize     = 1 << 20 //1m
+	__arenaPages    = __arenaSize / __pageSize
+	__maxOrder      = 8  //一个 span 最多 2^8 页, 即整个 arena
+	__minChunkShift = 3  //最小 chunk 8 字节, 放得下空闲链表的 next
+	__maxChunkShift = 20 //最大 chunk 等于 arena
+	__classes       = __maxChunkShift - __minChunkShift + 1
+	__localMaxBytes = 1 << 28 //256m
+)
+
+const (
+	__spanNone = iota //span 中间的页, 或者还没有 mmap
+	__spanUsed
+	__spanFree
+)
+
+var (
+	ErrLocalFull     = errors.New("local: memory limit reached")
+	ErrLocalTooLarge = errors.New("local: value too large")
+	ErrLocalClosed   = errors.New("local: closed")
+)
+
+// localRef chunk 的位置, 高 32 位是 arena 下标, 低 32 位是 arena 内偏移
+type localRef uint64
+
+func _chunkClass(n int) (uint8, bool) {
+
+	c := uint8(0)
+	for size := 1 << __minChunkShift; size < n; size <<= 1 {
+		c++
+	}
+	return c, c < __classes
+}
+
+func _chunkSize(c uint8) int {
+
+	return 1 << (__minChunkShift + c)
+}
+
+// _spanOrder c 级 chunk 所在 span 的页数是 2^order
+func _spanOrder(c uint8) uint8 {
+
+	order := uint8(0)
+	for __pageSize<<order < _chunkSize(c) {
+		order++
+	}
+	return order
+}
+
+// localSpan 以 span 第一页的页号为下标, 页号 = arena 下标 * __arenaPages + arena 内页号
+type localSpan struct {
+	state uint8
+	order uint8
+	class uint8
+	live  uint16
+	free  localRef //空闲 chunk 链表头 +1, 0 表示空
+	prev  int32    //partial 或空闲页池的双向链表
+	next  int32
+}
+
+type localSlab struct {
+	arenas   [][]byte
+	bases    []unsafe.Pointer //arena 的起始地址, 长度固定, 给 seqlock 读用
+	spans    []localSpan
+	partial  [__classes]int32      //有空闲 chunk 的 span, -1 表示空
+	pool     [__maxOrder + 1]int32 //空闲页池, 按 order 分开, -1 表示空
+	maxBytes int64
+	inUse    int64 //已分配 chunk 的字节数
+	closed   bool
+}
+
+func newLocalSlab(maxBytes int64) *localSlab {
+
+	arenas := maxBytes / __arenaSize
+	s := &localSlab{
+		maxBytes: maxBytes,
+		bases:    make([]unsafe.Pointer, arenas),
+		spans:    make([]localSpan, arenas*__arenaPages),
+	}
+	for i := range s.partial {
+		s.partial[i] = -1
+	}
+	for i := range s.pool {
+		s.pool[i] = -1
+	}
+	return s
+}
+
+func (s *localSlab) _link(head *int32, g int32) {
+
+	sp := &s.spans[g]
+	sp.prev, sp.next = -1, *head
+	if *head >= 0 {
+		s.spans[*head].prev = g
+	}
+	*head = g
+}
+
+func (s *localSlab) _unlink(head *int32, g int32) {
+
+	sp := &s.spans[g]
+	if sp.prev >= 0 {
+		s.spans[sp.prev].next = sp.next
+	} else {
+		*head = sp.next
+	}
+	if sp.next >= 0 {
+		s.spans[sp.next].prev = sp.prev
+	}
+	sp.prev, sp.next = -1, -1
+}
+
+func (s *localSlab) _arena() error {
+
+	if len(s.arenas) >= len(s.bases) {
+		return ErrLocalFull
+	}
+	arena, err := syscall.Mmap(-1, 0, __arenaSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&s.bases[len(s.arenas)], unsafe.Pointer(&arena[0]))
+	g := int32(len(s.arenas) * __arenaPages)
+	s.arenas = append(s.arenas, arena)
+	s.spans[g] = localSpan{state: __spanFree, order: __maxOrder}
+	s._link(&s.pool[__maxOrder], g)
+	return nil
+}
+
+// _span 从空闲页池取一个 2^order 页的 span, 大的对半切开, 另一半放回池里
+func (s *localSlab) _span(order uint8) (int32, error) {
+
+	j := order
+	for j <= __maxOrder && s.pool[j] < 0 {
+		j++
+	}
+	if j > __maxOrder {
+		err := s._arena()
+		if err != nil {
+			return -1, err
+		}
+		j = __maxOrder
+	}
+	g := s.pool[j]
+	s._unlink(&s.pool[j], g)
+	for j > order {
+		j--
+		buddy := g + 1<<j
+		s.spans[buddy] = localSpan{state: __spanFree, order: j}
+		s._link(&s.pool[j], buddy)
+	}
+	s.spans[g] = localSpan{order: order, prev: -1, next: -1}
+	return g, nil
+}
+
+// _freeSpan span 还给空闲页池, buddy 也空闲时合并成大一级的 span
+func (s *localSlab) _freeSpan(g int32) {
+
+	order := s.spans[g].order
+	for order < __maxOrder {
+		base := g / __arenaPages * __arenaPages
+		buddy := base + (g - base) ^ (1 << order)
+		b := &s.spans[buddy]
+		if b.state != __spanFree || b.order != order {
+			break
+		}
+		s._unlink(&s.pool[order], buddy)
+		b.state = __spanNone
+		if buddy < g {
+			s.spans[g].state = __spanNone
+			g = buddy
+		}
+		order++
+	}
+	s.spans[g] = localSpan{state: __spanFree, order: order}
+	s._link(&s.pool[order], g)
+}
+
+// _carve 把 span 切成 c 级的 chunk, 全部放进 span 的空闲链表
+func (s *localSlab) _carve(g int32, c uint8) {
+
+	sp := &s.spans[g]
+	sp.state = __spanUsed
+	sp.class = c
+	sp.live = 0
+	sp.free = 0
+	size := _chunkSize(c)
+	bytes := __pageSize << sp.order
+	start := s._ref(g)
+	for off := bytes - size; off >= 0; off -= size {
+		s._push(sp, start+localRef(off))
+	}
+	s._link(&s.partial[c], g)
+}
+
+func (s *localSlab) _push(sp *localSpan, ref localRef) {
+
+	binary.LittleEndian.PutUint64(s.bytes(ref, 8), uint64(sp.free))
+	sp.free = ref + 1
+}
+
+// _ref span 第一页的位置
+func (s *localSlab) _ref(g int32) localRef {
+
+	return localRef(g/__arenaPages)<<32 | localRef(g%__arenaPages*__pageSize)
+}
+
+// _page chunk 所在 span 的页号, 一个 span 超过一页时里面只有一个 chunk, 就在第一页
+func (s *localSlab) _page(ref localRef) int32 {
+
+	return int32(ref>>32)*__arenaPages + int32(ref&0xffffffff)/__pageSize
+}
+
+// alloc 分配一个能放下 n 字节的 chunk
+func (s *localSlab) alloc(n int) (uint8, localRef, error) {
+
+	if s.closed {
+		return 0, 0, ErrLocalClosed
+	}
+	c, ok := _chunkClass(n)
+	if !ok {
+		return 0, 0, ErrLocalTooLarge
+	}
+	g := s.partial[c]
+	if g < 0 {
+		var err error
+		g, err = s._span(_spanOrder(c))
+		if err != nil {
+			return 0, 0, err
+		}
+		s._carve(g, c)
+	}
+	sp := &s.spans[g]
+	ref := sp.free - 1
+	sp.free = localRef(binary.LittleEndian.Uint64(s.bytes(ref, 8)))
+	sp.live++
+	if sp.free == 0 {
+		s._unlink(&s.partial[c], g)
+	}
+	s.inUse += int64(_chunkSize(c))
+	return c, ref, nil
+}
+
+// release chunk 放回所属 span, span 空了就还给空闲页池
+func (s *localSlab) release(c uint8, ref localRef) {
+
+	if s.closed {
+		return
+	}
+	g := s._page(ref)
+	sp := &s.spans[g]
+	full := sp.free == 0
+	s._push(sp, ref)
+	sp.live--
+	s.inUse -= int64(_chunkSize(c))
+	switch {
+	case sp.live == 0:
+		if !full {
+			s._unlink(&s.partial[c], g)
+		}
+		s._freeSpan(g)
+	case full:
+		s._link(&s.partial[c], g)
+	}
+}
+
+// pages 已经 mmap 的页数
+func (s *localSlab) pages() int32 {
+
+	return int32(len(s.arenas) * __arenaPages)
+}
+
+// block 返回从 b 开始 2^order 页的块里所有在用的 chunk, b 按块的大小对齐
+// 块在一个更大的 span 里时返回那个 span 的 chunk
+func (s *localSlab) block(b int32, order uint8, dst []localRef) []localRef {
+
+	base := b / __arenaPages * __arenaPages
+	for j := order + 1; j <= __maxOrder; j++ {
+		a := base + (b-base)&^(1<<j-1)
+		if sp := &s.spans[a]; sp.state != __spanNone && sp.order >= j {
+			return s._live(a, dst)
+		}
+	}
+	for g := b; g < b+1<<order; {
+		sp := &s.spans[g]
+		if sp.state == __spanNone { //不会出现, 防止死循环
+			g++
+			continue
+		}
+		dst = s._live(g, dst)
+		g += 1 << sp.order
+	}
+	return dst
+}
+
+// _live span 里不在空闲链表上的 chunk
+func (s *localSlab) _live(g int32, dst []localRef) []localRef {
+
+	sp := &s.spans[g]
+	if sp.state != __spanUsed || sp.live == 0 {
+		return dst
+	}
+	var free [__pageSize / (1 << __minChunkShift) / 64]uint64
+	size := _chunkSize(sp.class)
+	start := s._ref(g)
+	for ref := sp.free; ref != 0; ref = localRef(binary.LittleEndian.Uint64(s.bytes(ref-1, 8))) {
+		i := int(ref-1-start) / size
+		free[i/64] |= 1 << (i % 64)
+	}
+	for off, i := 0, 0; off < __pageSize<<sp.order; off, i = off+size, i+1 {
+		if free[i/64]&(1<<(i%64)) == 0 {
+			dst = append(dst, start+localRef(off))
+		}
+	}
+	return dst
+}
+
+func (s *localSlab) bytes(ref localRef, n int) []byte {
+
+	off := int(ref & 0xffffffff)
+	return s.arenas[ref>>32][off : off+n]
+}
+
+// load 不加锁读 chunk, ref 和 n 可能来自写了一半的槽, 不合法返回 false
+func (s *localSlab) load(ref localRef, c uint8, n int) ([]byte, bool) {
+
+	idx := int(ref >> 32)
+	off := int(ref & 0xffffffff)
+	if idx >= len(s.bases) || c >= __classes || n > _chunkSize(c) || off+n > __arenaSize {
+		return nil, false
+	}
+	base := atomic.LoadPointer(&s.bases[idx])
+	if base == nil {
+		return nil, false
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(base, off)), n), true
+}
+
+func (s *localSlab) mapped() int64 {
+
+	return int64(len(s.arenas)) * __arenaSize
+}
+
+func (s *localSlab) close() error {
+
+	if s.closed {
+		return ErrLocalClosed
+	}
+	s.closed = true
+	for i := range s.bases {
+		atomic.StorePointer(&s.bases[i], nil)
+	}
+	var err error
+	for _, arena := range s.arenas {
+		e := syscall.Munmap(arena)
+		if e != nil {
+			err = e
+		}
+	}
+	s.arenas = nil
+	return err
+}
@@ -0,0 +1,441 @@
+package db
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// localShard 一个分片, 自己的 Robin Hood 表和 slab
+// 开放寻址, 冲突时离理想位置远的优先占位, 删除时后移回填, 不留墓碑
+// 装载率超过 __localLoad 时容量翻倍, 旧表在之后的每次写入里分批搬迁, 不一次性停顿
+// 槽里只有定长字段, key 和 value 存在 slab 的 chunk 里, chunk 开头 8 字节是 key 的 hash, 整页淘汰时用来找回槽
+//
+// 写入持 mu 的写锁, 并在修改前后各把 seq 加一, seq 为奇数表示正在写
+// 读有两种: 持 mu 的读锁, 或者不加锁读完再检查 seq 没变 (seqlock)
+// 为了 seqlock 读, 槽和表指针都用原子操作读写
+
+const (
+	__localCap   = 16 //初始槽数, 2 的幂
+	__localLoad  = 0.85
+	__rehashStep = 4  //每次写入最多搬迁的对象数
+	__seqRetries = 64 //seqlock 读重试次数, 超过后退回读锁
+	__chunkHdr   = 8
+)
+
+type localSlot struct {
+	hash  uint64
+	dist  uint32 //离理想位置的距离+1, 0 表示空槽
+	klen  uint32
+	vlen  uint32
+	class uint8
+	used  bool     //CLOCK 的访问位
+	ref   localRef //hash, key 和 value 连续存放在这个 chunk 里
+	exp   int64    //过期时间 unix nano, 0 不过期
+}
+
+func (s *localSlot) expired(now int64) bool {
+	return s.exp > 0 && now >= s.exp
+}
+
+// localCell 槽在表里的存储: hash, dist<<32|used<<8|class, klen<<32|vlen, ref, exp
+type localCell [5]uint64
+
+const __cellUsed = 1 << 8
+
+func (c *localCell) load() localSlot {
+
+	w1 := atomic.LoadUint64(&c[1])
+	w2 := atomic.LoadUint64(&c[2])
+	return localSlot{
+		hash:  atomic.LoadUint64(&c[0]),
+		dist:  uint32(w1 >> 32),
+		class: uint8(w1),
+		used:  w1&__cellUsed != 0,
+		klen:  uint32(w2 >> 32),
+		vlen:  uint32(w2),
+		ref:   localRef(atomic.LoadUint64(&c[3])),
+		exp:   int64(atomic.LoadUint64(&c[4])),
+	}
+}
+
+func (c *localCell) store(s localSlot) {
+
+	w1 := uint64(s.dist)<<32 | uint64(s.class)
+	if s.used {
+		w1 |= __cellUsed
+	}
+	atomic.StoreUint64(&c[0], s.hash)
+	atomic.StoreUint64(&c[1], w1)
+	atomic.StoreUint64(&c[2], uint64(s.klen)<<32|uint64(s.vlen))
+	atomic.StoreUint64(&c[3], uint64(s.ref))
+	atomic.StoreUint64(&c[4], uint64(s.exp))
+}
+
+// touch 置访问位, 读的时候调用, 和写并发时可能丢掉, 不影响正确性
+func (c *localCell) touch() {
+
+	old := atomic.LoadUint64(&c[1])
+	if old&__cellUsed == 0 {
+		atomic.CompareAndSwapUint64(&c[1], old, old|__cellUsed)
+	}
+}
+
+func (c *localCell) clear() {
+
+	old := atomic.LoadUint64(&c[1])
+	if old&__cellUsed != 0 {
+		atomic.CompareAndSwapUint64(&c[1], old, old&^__cellUsed)
+	}
+}
+
+type localTable struct {
+	cells []localCell
+	mask  uint64
+	count int
+}
+
+func newLocalTable(n int) *localTable {
+
+	return &localTable{
+		cells: make([]localCell, n),
+		mask:  uint64(n - 1),
+	}
+}
+
+// insert 调用方保证 key 不在表里
+func (t *localTable) insert(s localSlot) {
+
+	s.dist = 1
+	i := s.hash & t.mask
+	for {
+		cur := t.cells[i].load()
+		if cur.dist == 0 {
+			t.cells[i].store(s)
+			t.count++
+			return
+		}
+		if cur.dist < s.dist {
+			t.cells[i].store(s)
+			s = cur
+		}
+		i = (i + 1) & t.mask
+		s.dist++
+	}
+}
+
+// remove 把后面的槽依次前移一格, 直到空槽或者已在理想位置的槽
+func (t *localTable) remove(i uint64) {
+
+	for {
+		j := (i + 1) & t.mask
+		next := t.cells[j].load()
+		if next.dist <= 1 {
+			t.cells[i].store(localSlot{})
+			break
+		}
+		next.dist--
+		t.cells[i].store(next)
+		i = j
+	}
+	t.count--
+}
+
+func (t *localTable) full() bool {
+
+	return float64(t.count+1) > float64(len(t.cells))*__localLoad
+}
+
+type localShard struct {
+	mu   sync.RWMutex
+	seq  uint64
+	cur  unsafe.Pointer //*localTable
+	old  unsafe.Pointer //*localTable, 扩容中的旧表, 搬完后为 nil
+	hand uint64         //old 里下一个要搬迁的槽
+	slab *localSlab
+
+	clock     uint64 //CLOCK 的手, 在 cur 里的位置
+	pageHand  int32  //整页淘汰从哪一页开始找
+	victims   []localRef
+	sketch    *localSketch
+	evictions int64
+	rejected  int64
+
+	sweep   uint64 //清理过期对象的游标, 在 cur 里的位置
+	expired int64
+}
+
+func newLocalShard(maxBytes int64) *localShard {
+
+	return &localShard{
+		cur:    unsafe.Pointer(newLocalTable(__localCap)),
+		slab:   newLocalSlab(maxBytes),
+		sketch: newLocalSketch(maxBytes),
+	}
+}
+
+func (s *localShard) _tables() (*localTable, *localTable) {
+
+	return (*localTable)(atomic.LoadPointer(&s.cur)), (*localTable)(atomic.LoadPointer(&s.old))
+}
+
+// _lock 写锁并把 seq 改成奇数, 返回的函数解锁
+func (s *localShard) _lock() func() {
+
+	s.mu.Lock()
+	atomic.AddUint64(&s.seq, 1)
+	return func() {
+		atomic.AddUint64(&s.seq, 1)
+		s.mu.Unlock()
+	}
+}
+
+func (s *localShard) _find(t *localTable, h uint64, key string) (localSlot, int) {
+
+	i := h & t.mask
+	for d := uint32(1); ; d++ {
+		slot := t.cells[i].load()
+		if slot.dist < d { //空槽或者遇到更靠近理想位置的, key 不存在
+			return slot, -1
+		}
+		if slot.hash == h && int(slot.klen) == len(key) && BytesToString(s.slab.bytes(slot.ref+__chunkHdr, len(key))) == key {
+			return slot, int(i)
+		}
+		i = (i + 1) & t.mask
+	}
+}
+
+func (s *localShard) _lookup(h uint64, key string) (*localTable, localSlot, int) {
+
+	cur, old := s._tables()
+	if slot, i := s._find(cur, h, key); i >= 0 {
+		return cur, slot, i
+	}
+	if old != nil {
+		if slot, i := s._find(old, h, key); i >= 0 {
+			return old, slot, i
+		}
+	}
+	return nil, localSlot{}, -1
+}
+
+// _migrate 从 hand 开始搬迁最多 n 个对象
+// 旧表不再插入, hand 之前的槽都是空的, 被搬走的槽由后面的槽前移回填, 所以 hand 不前进
+func (s *localShard) _migrate(n int) {
+
+	cur, old := s._tables()
+	for old != nil && n > 0 {
+		if old.count == 0 {
+			atomic.StorePointer(&s.old, nil)
+			s.hand = 0
+			return
+		}
+		slot := old.cells[s.hand].load()
+		if slot.dist == 0 {
+			s.hand++
+			continue
+		}
+		cur.insert(slot)
+		old.remove(s.hand)
+		n--
+	}
+}
+
+func (s *localShard) _grow() {
+
+	cur, old := s._tables()
+	if old != nil { //上一次还没搬完, 先搬完
+		s._migrate(old.count + 1)
+	}
+	atomic.StorePointer(&s.old, unsafe.Pointer(cur))
+	s.hand = 0
+	atomic.StorePointer(&s.cur, unsafe.Pointer(newLocalTable(len(cur.cells)*2)))
+}
+
+func (s *localShard) _remove(t *localTable, i uint64) {
+
+	slot := t.cells[i].load()
+	t.remove(i)
+	s.slab.release(slot.class, slot.ref)
+}
+
+func (s *localShard) set(h uint64, key string, value []byte, exp int64) error {
+
+	s.sketch.increment(h)
+
+	unlock := s._lock()
+	defer unlock()
+
+	if s.slab.closed {
+		return ErrLocalClosed
+	}
+	s._migrate(__rehashStep)
+
+	n := __chunkHdr + len(key) + len(value)
+	t, slot, i := s._lookup(h, key)
+	cur, _ := s._tables()
+	if t == cur {
+		if c, _ := _chunkClass(n); c == slot.class { //同一级原地覆盖 value
+			slot.vlen = uint32(len(value))
+			slot.exp = exp
+			copy(s.slab.bytes(slot.ref+__chunkHdr+localRef(len(key)), len(value)), value)
+			t.cells[i].store(slot)
+			return nil
+		}
+	}
+
+	c, ref, admitted, err := s._alloc(h, n, t != nil)
+	if err != nil || !admitted {
+		return err
+	}
+	binary.LittleEndian.PutUint64(s.slab.bytes(ref, __chunkHdr), h)
+	copy(s.slab.bytes(ref+__chunkHdr, len(key)), key)
+	copy(s.slab.bytes(ref+__chunkHdr+localRef(len(key)), len(value)), value)
+	t, _, i = s._lookup(h, key) //淘汰时槽可能移动了
+	if t != nil {
+		s._remove(t, uint64(i))
+	}
+
+	cur, _ = s._tables()
+	if cur.full() {
+		s._grow()
+		cur, _ = s._tables()
+	}
+	cur.insert(localSlot{
+		hash:  h,
+		klen:  uint32(len(key)),
+		vlen:  uint32(len(value)),
+		class: c,
+		ref:   ref,
+		exp:   exp,
+	})
+	return nil
+}
+
+func (s *localShard) del(h uint64, key string) {
+
+	unlock := s._lock()
+	defer unlock()
+
+	if s.slab.closed {
+		return
+	}
+	s._migrate(__rehashStep)
+
+	t, _, i := s._lookup(h, key)
+	if t != nil {
+		s._remove(t, uint64(i))
+	}
+}
+
+func (s *localShard) read(dst []byte, h uint64, key string) ([]byte, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.slab.closed {
+		return dst, false
+	}
+	t, slot, i := s._lookup(h, key)
+	if t == nil || slot.expired(time.Now().UnixNano()) { //过期的留给 sweeper 删
+		return dst, false
+	}
+	t.cells[i].touch()
+	return append(dst, s.slab.bytes(slot.ref+__chunkHdr+localRef(slot.klen), int(slot.vlen))...), true
+}
+
+// readSeq 不加锁读, 读完 seq 变了就重试, 一直在写就退回读锁
+func (s *localShard) readSeq(dst []byte, h uint64, key string) ([]byte, bool) {
+
+	n := len(dst)
+	s.sketch.increment(h)
+	for retry := 0; retry < __seqRetries; retry++ {
+		seq := atomic.LoadUint64(&s.seq)
+		if seq&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		out, ok, valid := s._tryRead(dst[:n], h, key)
+		if valid && atomic.LoadUint64(&s.seq) == seq {
+			return out, ok
+		}
+	}
+	return s.read(dst[:n], h, key)
+}
+
+// _tryRead 读到的槽可能是写了一半的, 所有长度和位置都要检查, valid=false 要重试
+func (s *localShard) _tryRead(dst []byte, h uint64, key string) ([]byte, bool, bool) {
+
+	cur, old := s._tables()
+	for _, t := range [2]*localTable{cur, old} {
+		if t == nil {
+			continue
+		}
+		i := h & t.mask
+		for d := uint32(1); int(d) <= len(t.cells); d++ {
+			slot := t.cells[i].load()
+			if slot.dist < d {
+				break
+			}
+			if slot.hash == h && int(slot.klen) == len(key) {
+				kv, ok := s.slab.load(slot.ref, slot.class, __chunkHdr+int(slot.klen)+int(slot.vlen))
+				if !ok {
+					return dst, false, false
+				}
+				kv = kv[__chunkHdr:]
+				if BytesToString(kv[:slot.klen]) == key {
+					if slot.expired(time.Now().UnixNano()) {
+						return dst, false, true
+					}
+					t.cells[i].touch()
+					return append(dst, kv[slot.klen:]...), true, true
+				}
+			}
+			i = (i + 1) & t.mask
+		}
+	}
+	return dst, false, true
+}
+
+func (s *localShard) stats() LocalStats {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cur, old := s._tables()
+	stats := LocalStats{
+		Entries:     cur.count,
+		Slots:       len(cur.cells),
+		MappedBytes: s.slab.mapped(),
+		ChunkBytes:  s.slab.inUse,
+		Evictions:   s.evictions,
+		Rejected:    s.rejected,
+		Expired:     s.expired,
+	}
+	if old != nil {
+		stats.Entries += old.count
+		stats.Slots += len(old.cells)
+	}
+	return stats
+}
+
+func (s *localShard) close() error {
+
+	unlock := s._lock()
+	defer unlock()
+
+	err := s.slab.close()
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&s.cur, unsafe.Pointer(newLocalTable(__localCap)))
+	atomic.StorePointer(&s.old, nil)
+	s.hand = 0
+	s.clock = 0
+	s.pageHand = 0
+	s.sweep = 0
+	return nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLocalConcurrent 多个协程同时读写删, 用 go test -race 检查数据竞争
+// value 是 key:长度:填充, 读到别的 key 或者长度对不上说明读到了写了一半的数据
+// small 时内存只有一个 arena, value 大小不一, 淘汰, 整页回收和扩容都会和读并发
+func TestLocalConcurrent(t *testing.T) {
+
+	for _, seqlock := range []bool{false, true} {
+		for _, small := range []bool{false, true} {
+			name := fmt.Sprintf("seqlock=%v/small=%v", seqlock, small)
+			t.Run(name, func(t *testing.T) {
+				testLocalConcurrent(t, seqlock, small)
+			})
+		}
+	}
+}
+
+func testLocalConcurrent(t *testing.T, seqlock, small bool) {
+
+	opts := LocalOptions{
+		MaxBytes:     1 << 26,
+		Shards:       4,
+		SeqlockReads: seqlock,
+	}
+	keys := 2048
+	if small {
+		opts.MaxBytes = __arenaSize
+		keys = 1 << 14
+	}
+	local := NewLocalWithOptions(opts)
+	defer local.Close()
+
+	const (
+		writers = 4
+		readers = 8
+		rounds  = 20000
+	)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers+readers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := "k" + strconv.Itoa((i*7+w)%keys)
+				if i%5 == 0 {
+					local.Del(key)
+					continue
+				}
+				n := i % 100
+				if small {
+					n = 1 << (i % 12) //8 字节到 2k, 不同的 chunk 级抢同一批页
+				}
+				value := key + ":" + strconv.Itoa(n) + ":" + strings.Repeat("v", n)
+				err := local.SetEx(key, []byte(value), time.Duration(i%3)*time.Millisecond)
+				if err != nil {
+					errs <- fmt.Errorf("set %s: %w", key, err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			buf := make([]byte, 0, 256)
+			for i := 0; i < rounds; i++ {
+				key := "k" + strconv.Itoa((i*13+r)%keys)
+				var ok bool
+				buf, ok = local.AppendValue(buf[:0], key)
+				if !ok {
+					continue
+				}
+				parts := bytes.SplitN(buf, []byte(":"), 3)
+				if len(parts) != 3 || string(parts[0]) != key || string(parts[1]) != strconv.Itoa(len(parts[2])) {
+					errs <- fmt.Errorf("torn read %s: %q", key, buf)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	stats := local.Stats()
+	if stats.MappedBytes > opts.MaxBytes {
+		t.Fatalf("mapped %d > %d", stats.MappedBytes, opts.MaxBytes)
+	}
+	if small && stats.Evictions == 0 {
+		t.Fatalf("no evictions: %+v", stats)
+	}
+	t.Logf("%+v", stats)
+}
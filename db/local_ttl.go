@@ -0,0 +1,60 @@
+package db
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Get 读到过期对象时只当作不存在, 读锁和 seqlock 读都不能删除
+// 后台每 SweepInterval 给每个分片扫 SweepBatch 个槽, 删掉过期的, 每次持锁的时间有上限
+
+const (
+	__sweepInterval = time.Second
+	__sweepBatch    = 1024
+)
+
+func (l *Local) _sweeper() {
+
+	ticker := time.NewTicker(l.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		for _, shard := range l.shards {
+			if atomic.LoadInt32(&l.closed) == 1 {
+				return
+			}
+			shard.sweepBatch(l.sweepBatch)
+		}
+	}
+}
+
+// sweepBatch 从游标开始检查最多 n 个槽, 删除后后面的槽前移, 游标不前进
+// 扩容中旧表里的过期对象搬到新表后再删
+func (s *localShard) sweepBatch(n int) int {
+
+	unlock := s._lock()
+	defer unlock()
+
+	if s.slab.closed {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	cur, _ := s._tables()
+	removed := 0
+	for visits := 0; visits < n && cur.count > 0; visits++ {
+		i := s.sweep & cur.mask
+		slot := cur.cells[i].load()
+		if slot.dist != 0 && slot.expired(now) {
+			s._remove(cur, i)
+			removed++
+			continue
+		}
+		s.sweep++
+	}
+	s.expired += int64(removed)
+	return removed
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"time"
+	"zcache/utils"
 
 	"github.com/qiniu/qmgo"
 	"github.com/qiniu/qmgo/operator"
@@ -27,19 +28,25 @@ func NewMdb(
 	}
 }
 
-func (m *Mdb) InitIndex(table string) error {
+// InitIndex 给主键建唯一索引, fields 为空时用 id, 主键是 _id 时不用建
+func (m *Mdb) InitIndex(table string, fields ...string) error {
 
+	if len(fields) == 0 {
+		fields = []string{"id"}
+	}
+	if len(fields) == 1 && fields[0] == "_id" {
+		return nil
+	}
 	unique := true
 	background := true
 	opt := &options.IndexOptions{
 		Unique:     &unique,
 		Background: &background,
 	}
-	key := []string{"id"}
 	err := m.db.Collection(table).
 		CreateOneIndex(context.Background(),
 			opts.IndexModel{
-				Key:          key,
+				Key:          fields,
 				IndexOptions: opt,
 			})
 	if err != nil {
@@ -48,7 +55,27 @@ func (m *Mdb) InitIndex(table string) error {
 	return nil
 }
 
-func (m *Mdb) Set(table, id string, out map[string]interface{}) error {
+// _filter 主键的每个 field 都要相等, 值保留原来的类型
+func _filter(key utils.ObjKey) bson.M {
+
+	filter := make(bson.M, len(key.Fields))
+	for i, field := range key.Fields {
+		filter[field] = key.Values[i]
+	}
+	return filter
+}
+
+func _hasField(key utils.ObjKey, field string) bool {
+
+	for _, f := range key.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mdb) Set(table string, key utils.ObjKey, out map[string]interface{}) error {
 
 	now := time.Now()
 	_out := map[string]interface{}{}
@@ -57,16 +84,15 @@ func (m *Mdb) Set(table, id string, out map[string]interface{}) error {
 	}
 	_out["updateAt"] = now
 
-	_id := primitive.NewObjectID()
-	out["_id"] = _id
+	if !_hasField(key, "_id") {
+		out["_id"] = primitive.NewObjectID()
+	}
 	out["createAt"] = now
 	out["updateAt"] = now
 
 	err := m.db.Collection(table).
 		Find(context.Background(),
-			bson.M{
-				"id": id,
-			}).
+			_filter(key)).
 		Apply(qmgo.Change{
 			Upsert: true,
 			Update: bson.M{
@@ -81,13 +107,11 @@ func (m *Mdb) Set(table, id string, out map[string]interface{}) error {
 	return nil
 }
 
-func (m *Mdb) Get(table, id string, info interface{}) error {
+func (m *Mdb) Get(table string, key utils.ObjKey, info interface{}) error {
 
 	err := m.db.Collection(table).
 		Find(context.Background(),
-			bson.M{
-				"id": id,
-			}).
+			_filter(key)).
 		One(info)
 	if err != nil {
 		log.Println("obj_find: ", err)
@@ -96,13 +120,11 @@ func (m *Mdb) Get(table, id string, info interface{}) error {
 	return nil
 }
 
-func (m *Mdb) Del(table, id string) error {
+func (m *Mdb) Del(table string, key utils.ObjKey) error {
 
 	err := m.db.Collection(table).
 		Remove(context.Background(),
-			bson.M{
-				"id": id,
-			})
+			_filter(key))
 	if err != nil {
 		log.Println("obj_find: ", err)
 		return err
@@ -110,15 +132,13 @@ func (m *Mdb) Del(table, id string) error {
 	return nil
 }
 
-func (m *Mdb) IncrBy(table, id string, info interface{}, out map[string]interface{}) error {
+func (m *Mdb) IncrBy(table string, key utils.ObjKey, info interface{}, out map[string]interface{}) error {
 
 	now := time.Now()
 
 	err := m.db.Collection(table).
 		Find(context.Background(),
-			bson.M{
-				"id": id,
-			}).
+			_filter(key)).
 		Apply(qmgo.Change{
 			ReturnNew: true,
 			Update: bson.M{
@@ -135,16 +155,14 @@ func (m *Mdb) IncrBy(table, id string, info interface{}, out map[string]interfac
 	return nil
 }
 
-func (m *Mdb) Getset(table, id string, info interface{}, out map[string]interface{}) error {
+func (m *Mdb) Getset(table string, key utils.ObjKey, info interface{}, out map[string]interface{}) error {
 
 	now := time.Now()
 	out["updateAt"] = now
 
 	err := m.db.Collection(table).
 		Find(context.Background(),
-			bson.M{
-				"id": id,
-			}).
+			_filter(key)).
 		Apply(qmgo.Change{
 			ReturnNew: true,
 			Update: bson.M{
@@ -158,13 +176,11 @@ func (m *Mdb) Getset(table, id string, info interface{}, out map[string]interfac
 	return nil
 }
 
-func (m *Mdb) DelField(table, id string, out map[string]interface{}) error {
+func (m *Mdb) DelField(table string, key utils.ObjKey, out map[string]interface{}) error {
 
 	err := m.db.Collection(table).
 		UpdateOne(context.Background(),
-			bson.M{
-				"id": id,
-			}, bson.M{
+			_filter(key), bson.M{
 				operator.Unset: out,
 			})
 	if err != nil {
@@ -3,7 +3,9 @@ package db
 import (
 	"context"
 	"log"
-	"strings"
+	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 	"zcache/utils"
 
@@ -14,22 +16,100 @@ const (
 	__expire = time.Second * 60 * 60 * 24 * 10
 	__topic  = "__keyspace@0__:"
 	__notify = "notify-keyspace-events"
-	__events = "eghKx"
+	__events = "eghKx$"
 
+	// KEYS[1]=key, ARGV=field1, value1, field2, value2...
+	// 返回 field1, old1, field2, old2..., 不存在的 old 是 nil
 	__getset_lua = `
-local q_key = tostring(ARGV[1])
-local q_field = tostring(ARGV[2])
-local q_value = ARGV[3]
-
-local value = redis.call('hget', q_key, q_field)
-redis.call('hset', q_key, q_field, q_value)
-return value`
+local n = #ARGV / 2
+local fields = {}
+for i = 1, n do
+	fields[i] = ARGV[2 * i - 1]
+end
+
+local old = redis.call('hmget', KEYS[1], unpack(fields))
+redis.call('hset', KEYS[1], unpack(ARGV))
+
+local ret = {}
+for i = 1, n do
+	ret[2 * i - 1] = fields[i]
+	ret[2 * i] = old[i]
+end
+return ret`
+
+	// KEYS[1]=key, ARGV=field1, 类型, 增量, field2, 类型, 增量... 类型 i 用 hincrby, f 用 hincrbyfloat
+	// 先检查所有旧值和结果, 有一个不是数字, 整数溢出或者浮点数得到 inf/nan 就都不改; 返回 field1, new1, field2, new2...
+	// lua 的数字是 double, 整数按 1e9 拆成高低两段相加, 两段都在 2^53 以内, 结果是精确的
+	__incrby_lua = `
+local function split(s)
+	local neg = string.sub(s, 1, 1) == '-'
+	if neg then
+		s = string.sub(s, 2)
+	end
+	local hi = 0
+	if #s > 9 then
+		hi = tonumber(string.sub(s, 1, #s - 9))
+	end
+	local lo = tonumber(string.sub(s, math.max(#s - 8, 1)))
+	if neg then
+		return -hi, -lo
+	end
+	return hi, lo
+end
+
+for i = 1, #ARGV, 3 do
+	local cur = redis.call('hget', KEYS[1], ARGV[i]) or '0'
+	if ARGV[i + 1] == 'i' then
+		if not string.match(cur, '^%-?%d+$') then
+			return redis.error_reply('ERR hash value is not an integer: ' .. ARGV[i])
+		end
+		local h1, l1 = split(cur)
+		local h2, l2 = split(ARGV[i + 2])
+		local l = l1 + l2
+		local h = h1 + h2 + math.floor(l / 1e9)
+		l = l % 1e9
+		if h > 9223372036 or (h == 9223372036 and l > 854775807) or
+			h < -9223372037 or (h == -9223372037 and l < 145224192) then
+			return redis.error_reply('ERR increment or decrement would overflow: ' .. ARGV[i])
+		end
+	else
+		local v = tonumber(cur)
+		if not v then
+			return redis.error_reply('ERR hash value is not a number: ' .. ARGV[i])
+		end
+		v = v + tonumber(ARGV[i + 2])
+		if v ~= v or v == math.huge or v == -math.huge then
+			return redis.error_reply('ERR increment would produce NaN or Infinity: ' .. ARGV[i])
+		end
+	end
+end
+
+local ret = {}
+for i = 1, #ARGV, 3 do
+	ret[#ret + 1] = ARGV[i]
+	if ARGV[i + 1] == 'f' then
+		ret[#ret + 1] = redis.call('hincrbyfloat', KEYS[1], ARGV[i], ARGV[i + 2])
+	else
+		ret[#ret + 1] = redis.call('hincrby', KEYS[1], ARGV[i], ARGV[i + 2])
+	end
+end
+return ret`
 )
 
 type Rdb struct {
-	db        *redis.ClusterClient
-	getsetSha string
-	topic     string
+	db      *redis.ClusterClient
+	rootKey string
+	topic   string
+	scripts rdbScripts
+
+	ttl      time.Duration
+	tableTTL map[string]time.Duration
+	jitter   float64
+	rand     *rand.Rand
+	randMu   sync.Mutex
+	slide    *rdbSlide
+	blobs    map[string]RdbCodec
+	limits   Limits
 }
 
 func NewRdb(
@@ -37,104 +117,133 @@ func NewRdb(
 	client *redis.ClusterClient,
 ) *Rdb {
 
-	rdb := &Rdb{
-		db:    client,
-		topic: utils.Sprintf(__topic, rootKey, "*"),
-	}
-	rdb.getsetSha, _ = rdb._loadLua(__getset_lua)
-
-	return rdb
+	return NewRdbWithOptions(rootKey, client, RdbOptions{})
 }
 
-func (r *Rdb) _loadLua(code string) (string, error) {
+func NewRdbWithOptions(
+	rootKey string,
+	client *redis.ClusterClient,
+	opts RdbOptions,
+) *Rdb {
 
-	script := redis.NewScript(code)
-	sha, err := script.Load(context.Background(), r.db).Result()
-	if err != nil {
-		log.Println("err_load", err)
-		return "", nil
+	if opts.TTL <= 0 {
+		opts.TTL = __expire
 	}
-	return sha, nil
-}
-
-func (r *Rdb) _evalLua(sha string, keys []string, args ...interface{}) interface{} {
-
-	result, err := r.db.EvalSha(context.Background(), sha, keys, args...).Result()
-	if err != nil {
-		log.Println("err_eval	", err)
-		return nil
+	if opts.Jitter == 0 {
+		opts.Jitter = __jitter
 	}
-	return result
-}
-
-func (r *Rdb) OnChange(cb func(op, key string)) {
-
-	r.db.ForEachMaster(context.Background(), func(ctx context.Context, client *redis.Client) error {
-
-		_, err := client.ConfigSet(context.Background(), __notify, __events).Result()
-		if err != nil {
-			return err
+	if opts.Jitter >= 1 {
+		log.Println("rdb_jitter_err	", rootKey, opts.Jitter)
+		opts.Jitter = __maxJitter
+	}
+	if opts.SlideRate <= 0 {
+		opts.SlideRate = __slideRate
+	}
+	rdb := &Rdb{
+		db:       client,
+		rootKey:  rootKey,
+		topic:    utils.Sprintf(__topic, rootKey, "*"),
+		ttl:      opts.TTL,
+		tableTTL: map[string]time.Duration{},
+		jitter:   opts.Jitter,
+		blobs:    map[string]RdbCodec{},
+		limits:   opts.Limits,
+	}
+	for table, ttl := range opts.TableTTL {
+		if ttl <= 0 {
+			// EXPIRE <=0 会在 HSET 之后马上删掉 key
+			log.Println("rdb_ttl_err	", rootKey, table, ttl)
+			continue
 		}
-		sub := client.PSubscribe(context.Background(), r.topic)
-		_, err = sub.Receive(context.Background())
-		if err != nil {
-			log.Println("Receive	", err)
-			return err
+		rdb.tableTTL[table] = ttl
+	}
+	for table, codec := range opts.BlobTables {
+		rdb.blobs[table] = codec
+	}
+	rdb.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	if opts.Sliding {
+		rdb.slide = &rdbSlide{
+			queue: make(chan string, __slideQueue),
+			rate:  opts.SlideRate,
 		}
+		go rdb._slider()
+	}
+	rdb.scripts.scripts = map[string]*rdbScript{}
+	err := rdb.RegisterScript(__getsetScript, __getset_lua)
+	if err != nil {
+		log.Println("err_load	", err)
+	}
+	err = rdb.RegisterScript(__incrbyScript, __incrby_lua)
+	if err != nil {
+		log.Println("err_load	", err)
+	}
 
-		for msg := range sub.Channel() {
-
-			keys := strings.Split(msg.Channel, __topic)
-			if len(keys) != 2 {
-				continue
-			}
-			key := keys[1]
-
-			cb(msg.Payload, key)
-		}
-		return nil
-	})
+	return rdb
 }
 
+// Exists allKeys 里每一项是 key, field; blob 模式的 table 用 EXISTS, 只看 key
+// 某个 key 返回 Redis 的错误 (比如 WRONGTYPE) 时当作不存在, 不影响其他 key
 func (r *Rdb) Exists(allKeys [][]string) ([]int64, error) {
 
 	ctx := context.Background()
 	pipe := r.db.Pipeline()
 	for _, keys := range allKeys {
+		if r.IsBlob(r._table(keys[0])) {
+			pipe.Exists(ctx, keys[0])
+			continue
+		}
 		pipe.HExists(ctx, keys[0], keys[1])
 	}
-	cmds, err := pipe.Exec(context.Background())
-	if err != nil {
-		return nil, err
-	}
+	cmds, _ := pipe.Exec(ctx)
 	allExists := make([]int64, len(allKeys))
 	for i, cmd := range cmds {
-		ret, ok := cmd.(*redis.IntCmd)
-		if !ok {
-			continue
-		}
-		exists, err := ret.Result()
+		err := cmd.Err()
 		if err != nil {
+			if _, ok := err.(redis.Error); ok {
+				log.Println("rdb_exists_err	", allKeys[i][0], err)
+				continue
+			}
 			return nil, err
 		}
-		allExists[i] = exists
+		switch ret := cmd.(type) {
+		case *redis.BoolCmd:
+			if ret.Val() {
+				allExists[i] = 1
+			}
+		case *redis.IntCmd:
+			allExists[i] = ret.Val()
+		}
 	}
 	return allExists, nil
 }
 
 func (r *Rdb) Set(key string, out map[string]interface{}) error {
 
+	err := r.CheckLimit(key, out)
+	if err != nil {
+		return err
+	}
 	ctx := context.Background()
 	pipe := r.db.Pipeline()
 	pipe.HSet(ctx, key, out)
-	pipe.Expire(ctx, key, __expire)
-	_, err := pipe.Exec(ctx)
+	pipe.Expire(ctx, key, r._ttl(key))
+	_, err = pipe.Exec(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// CheckLimit out 超出 key 所在 table 的 Limits 时返回 ErrTooLarge
+func (r *Rdb) CheckLimit(key string, out map[string]interface{}) error {
+
+	if !r.limits.Enabled() {
+		return nil
+	}
+	table, id := r._splitKey(key)
+	return r.limits.check("rdb", table, id, len(out), _outSize(out))
+}
+
 func (r *Rdb) Get(key string, info interface{}) error {
 
 	ret := r.db.HGetAll(context.Background(), key)
@@ -146,9 +255,20 @@ func (r *Rdb) Get(key string, info interface{}) error {
 	if err != nil {
 		return err
 	}
+	r._touch(key)
 	return nil
 }
 
+// GetAll 返回 hash 的原始值, 不做类型转换
+func (r *Rdb) GetAll(key string) (map[string]string, error) {
+
+	data, err := r.db.HGetAll(context.Background(), key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func (r *Rdb) Del(key string) error {
 
 	_, err := r.db.Del(context.Background(), key).Result()
@@ -173,36 +293,63 @@ func (r *Rdb) DelField(key string, info interface{}, out map[string]interface{})
 	return nil
 }
 
-//只对一个int64字段 原子加
-func (r *Rdb) IncrBy(key string, out map[string]interface{}) (int64, error) {
+// IncrBy 原子地给 out 里所有数字 field 加上增量, 整数用 HINCRBY, 浮点数用 HINCRBYFLOAT
+// 返回新值, 整数是 int64, 浮点数是 float64; 不是数字的 field 跳过
+func (r *Rdb) IncrBy(key string, out map[string]interface{}) (map[string]interface{}, error) {
 
+	args := make([]interface{}, 0, len(out)*3)
 	for field, value := range out {
-
+		if utils.IsFloat(value) {
+			number, _ := utils.ToFloat(value)
+			args = append(args, field, "f", strconv.FormatFloat(number, 'f', -1, 64))
+			continue
+		}
 		number, ok := utils.ToNumber(value)
 		if !ok {
 			continue
 		}
-		ret, err := r.db.HIncrBy(context.Background(), key, field, number).Result()
-		if err != nil {
-			log.Println("obj_incr	", err)
-			return 0, err
+		args = append(args, field, "i", number)
+	}
+	if len(args) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	values, err := r.Run(__incrbyScript, []string{key}, args...).Slice()
+	if err != nil {
+		log.Println("obj_incr	", err)
+		return nil, err
+	}
+	ret := make(map[string]interface{}, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := values[i].(string)
+		switch value := values[i+1].(type) {
+		case int64:
+			ret[field] = value
+		case string:
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			ret[field] = number
 		}
-		return ret, nil
 	}
-	return 0, nil
+	return ret, nil
 }
 
-func (r *Rdb) GetSet(key string, info interface{}, out map[string]interface{}) (interface{}, error) {
+// GetSet 原子地写入 out 的所有 field, 返回它们的旧值, 原来不存在的 field 不在返回里
+func (r *Rdb) GetSet(key string, info interface{}, out map[string]interface{}) (map[string]string, error) {
 
+	if len(out) == 0 {
+		return map[string]string{}, nil
+	}
+	args := make([]interface{}, 0, len(out)*2)
 	for field, value := range out {
-
-		ret := r._evalLua(
-			r.getsetSha,
-			nil,
-			key,
-			field,
-			value)
-		return ret, nil
+		args = append(args, field, value)
+	}
+	old, err := ScriptMap(r.Run(__getsetScript, []string{key}, args...))
+	if err != nil {
+		log.Println("obj_getset	", err)
+		return nil, err
 	}
-	return nil, nil
+	return old, nil
 }
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// blob 模式: 整个对象用 codec 编码成一个 string, 一个 key 一次 GET/SETEX, 批量用 MGET
+// 嵌套的 struct, slice, map 都可以存, 不受 HGETALL+Scan 只支持标量的限制
+// 按 table 在 RdbOptions.BlobTables 里打开; IncrBy, GetSet 这些改部分 field 的操作只能用 hash 模式
+
+const __slots = 16384
+
+type RdbCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// BSONCodec 和 Mdb 用同样的 bson tag
+type BSONCodec struct{}
+
+func (BSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(v)
+}
+
+func (BSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return bson.Unmarshal(data, v)
+}
+
+// IsBlob table 是否用 blob 模式
+func (r *Rdb) IsBlob(table string) bool {
+
+	_, ok := r.blobs[table]
+	return ok
+}
+
+// _codec 没有配置的 table 用 JSONCodec
+func (r *Rdb) _codec(key string) RdbCodec {
+
+	codec := r.blobs[r._table(key)]
+	if codec == nil {
+		return JSONCodec{}
+	}
+	return codec
+}
+
+func (r *Rdb) SetBlob(key string, info interface{}) error {
+
+	data, err := r._codec(key).Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = r._checkBlob(key, data)
+	if err != nil {
+		return err
+	}
+	return r.db.SetEX(context.Background(), key, data, r._ttl(key)).Err()
+}
+
+// CheckBlobLimit 和 SetBlob 一样按编码后的大小检查, 没有 field 数
+func (r *Rdb) CheckBlobLimit(key string, info interface{}) error {
+
+	if !r.limits.Enabled() {
+		return nil
+	}
+	data, err := r._codec(key).Marshal(info)
+	if err != nil {
+		return err
+	}
+	return r._checkBlob(key, data)
+}
+
+func (r *Rdb) _checkBlob(key string, data []byte) error {
+
+	if !r.limits.Enabled() {
+		return nil
+	}
+	table, id := r._splitKey(key)
+	return r.limits.check("rdb", table, id, 0, len(data))
+}
+
+// GetBlob 不存在时返回 redis.Nil
+func (r *Rdb) GetBlob(key string, info interface{}) error {
+
+	data, err := r.db.Get(context.Background(), key).Bytes()
+	if err != nil {
+		return err
+	}
+	err = r._codec(key).Unmarshal(data, info)
+	if err != nil {
+		return err
+	}
+	r._touch(key)
+	return nil
+}
+
+// MGetBlob infos[i] 是 keys[i] 要解到的指针, 返回每个 key 是否找到
+// 集群里 MGET 的 key 必须在同一个 slot, 按 slot 分组后用一个 pipeline 发出去
+// 解码失败的当作不存在
+func (r *Rdb) MGetBlob(keys []string, infos []interface{}) ([]bool, error) {
+
+	found := make([]bool, len(keys))
+	groups := map[int][]int{}
+	for i, key := range keys {
+		slot := _slot(key)
+		groups[slot] = append(groups[slot], i)
+	}
+
+	ctx := context.Background()
+	pipe := r.db.Pipeline()
+	indexes := make([][]int, 0, len(groups))
+	for _, idx := range groups {
+		batch := make([]string, len(idx))
+		for j, i := range idx {
+			batch[j] = keys[i]
+		}
+		pipe.MGet(ctx, batch...)
+		indexes = append(indexes, idx)
+	}
+	cmds, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for n, cmd := range cmds {
+		values, err := cmd.(*redis.SliceCmd).Result()
+		if err != nil {
+			return nil, err
+		}
+		for j, value := range values {
+			i := indexes[n][j]
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			err = r._codec(keys[i]).Unmarshal([]byte(data), infos[i])
+			if err != nil {
+				log.Println("rdb_blob_decode	", keys[i], err)
+				continue
+			}
+			found[i] = true
+			r._touch(keys[i])
+		}
+	}
+	return found, nil
+}
+
+// _slot 和 redis 集群一样: 有 {hashtag} 时只算 hashtag, crc16(XMODEM) % 16384
+func _slot(key string) int {
+
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	crc := uint16(0)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % __slots
+}
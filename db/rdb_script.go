@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Lua 脚本按名字注册到 Rdb, 注册时在每个 master 上 SCRIPT LOAD
+// Run 先 EVALSHA, master 切换或者 SCRIPT FLUSH 之后会收到 NOSCRIPT,
+// 这时用 EVAL 执行这一次, 并在后台把所有脚本重新加载到每个 master
+// 返回 *redis.Cmd, 用 Int64/Float64/Text/Slice 等取出类型化的结果, 错误不会被吞掉
+
+const (
+	__getsetScript = "getset"
+	__incrbyScript = "incrby"
+)
+
+var ErrRdbNoScript = errors.New("rdb: script not registered")
+
+type rdbScript struct {
+	src    string
+	script *redis.Script
+}
+
+type rdbScripts struct {
+	mu        sync.RWMutex
+	scripts   map[string]*rdbScript
+	reloading int32
+}
+
+// RegisterScript 注册脚本并加载到每个 master, 同名的会被替换
+// 加载失败也会注册, Run 的时候用 EVAL 兜底
+func (r *Rdb) RegisterScript(name, src string) error {
+
+	s := &rdbScript{
+		src:    src,
+		script: redis.NewScript(src),
+	}
+	r.scripts.mu.Lock()
+	r.scripts.scripts[name] = s
+	r.scripts.mu.Unlock()
+
+	return r._loadScripts(context.Background(), s)
+}
+
+func (r *Rdb) _script(name string) (*rdbScript, bool) {
+
+	r.scripts.mu.RLock()
+	defer r.scripts.mu.RUnlock()
+
+	s, ok := r.scripts.scripts[name]
+	return s, ok
+}
+
+// _loadScripts 只加载到 master, 从库提升为 master 后靠 NOSCRIPT 触发重新加载
+func (r *Rdb) _loadScripts(ctx context.Context, scripts ...*rdbScript) error {
+
+	return r.db.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		for _, s := range scripts {
+			err := client.ScriptLoad(ctx, s.src).Err()
+			if err != nil {
+				return fmt.Errorf("%s: %w", client.Options().Addr, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ReloadScripts 把所有已注册的脚本重新加载到每个 master
+func (r *Rdb) ReloadScripts() error {
+
+	r.scripts.mu.RLock()
+	scripts := make([]*rdbScript, 0, len(r.scripts.scripts))
+	for _, s := range r.scripts.scripts {
+		scripts = append(scripts, s)
+	}
+	r.scripts.mu.RUnlock()
+
+	return r._loadScripts(context.Background(), scripts...)
+}
+
+func (r *Rdb) _reloadAsync() {
+
+	if !atomic.CompareAndSwapInt32(&r.scripts.reloading, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&r.scripts.reloading, 0)
+		err := r.ReloadScripts()
+		if err != nil {
+			log.Println("rdb_reload_script_err	", err)
+		}
+	}()
+}
+
+func _isNoScript(err error) bool {
+
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// Run 执行注册过的脚本, 脚本里用到的 key 都要放在 keys 里, 集群按 keys[0] 路由
+func (r *Rdb) Run(name string, keys []string, args ...interface{}) *redis.Cmd {
+
+	ctx := context.Background()
+	s, ok := r._script(name)
+	if !ok {
+		cmd := redis.NewCmd(ctx)
+		cmd.SetErr(fmt.Errorf("%w: %s", ErrRdbNoScript, name))
+		return cmd
+	}
+	cmd := s.script.EvalSha(ctx, r.db, keys, args...)
+	if !_isNoScript(cmd.Err()) {
+		return cmd
+	}
+	r._reloadAsync()
+	return s.script.Eval(ctx, r.db, keys, args...)
+}
+
+// ScriptMap 把脚本返回的 field1, value1, field2, value2... 转成 map, value 为 nil 的跳过
+func ScriptMap(cmd *redis.Cmd) (map[string]string, error) {
+
+	values, err := cmd.Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("rdb: odd number of values %d", len(values))
+	}
+	ret := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		field, ok := values[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("rdb: field %v is not a string", values[i])
+		}
+		switch value := values[i+1].(type) {
+		case nil:
+		case string:
+			ret[field] = value
+		default:
+			ret[field] = fmt.Sprint(value)
+		}
+	}
+	return ret, nil
+}
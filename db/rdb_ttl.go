@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 过期时间按 table 配置, 再随机减去最多 Jitter 比例, 同一批写入的对象不会在同一秒过期
+// Sliding 时 Get 命中会把 key 放进队列, 后台每 __slideFlush 用一个 pipeline 续期,
+// 每秒最多续 SlideRate 个, 队列满了或者超出速率的直接丢掉, 下次命中再续
+
+const (
+	__jitter     = 0.1
+	__maxJitter  = 0.9 //>=1 时过期时间可能减到 0 以下
+	__slideRate  = 1000
+	__slideFlush = time.Millisecond * 100
+	__slideQueue = 4096
+)
+
+type RdbOptions struct {
+	// 默认的过期时间, 0 时用 __expire
+	TTL time.Duration
+	// 按 table 覆盖 TTL, <=0 的忽略, 用 TTL
+	TableTTL map[string]time.Duration
+	// 过期时间随机缩短的最大比例, 0 时用 __jitter, <0 不加随机, >=1 时按 __maxJitter
+	Jitter float64
+
+	// Get 命中时续期
+	Sliding bool
+	// 每秒最多续期的 key 数
+	SlideRate int
+
+	// 用 blob 模式存的 table 和它的 codec, codec 为 nil 时用 JSONCodec
+	BlobTables map[string]RdbCodec
+
+	// 超出的 Set, SetBlob 返回 ErrTooLarge
+	Limits Limits
+}
+
+type rdbSlide struct {
+	queue chan string
+	rate  int
+}
+
+// _splitKey key 是 rootKey/table/id
+func (r *Rdb) _splitKey(key string) (string, string) {
+
+	key = strings.TrimPrefix(key, r.rootKey+"/")
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+func (r *Rdb) _table(key string) string {
+
+	table, _ := r._splitKey(key)
+	return table
+}
+
+func (r *Rdb) _ttl(key string) time.Duration {
+
+	ttl, ok := r.tableTTL[r._table(key)]
+	if !ok {
+		ttl = r.ttl
+	}
+	if r.jitter <= 0 {
+		return ttl
+	}
+	r.randMu.Lock()
+	cut := time.Duration(r.rand.Float64() * r.jitter * float64(ttl))
+	r.randMu.Unlock()
+	return ttl - cut
+}
+
+func (r *Rdb) _touch(key string) {
+
+	if r.slide == nil {
+		return
+	}
+	select {
+	case r.slide.queue <- key:
+	default:
+	}
+}
+
+func (r *Rdb) _slider() {
+
+	ticker := time.NewTicker(__slideFlush)
+	defer ticker.Stop()
+
+	limit := r.slide.rate * int(__slideFlush) / int(time.Second)
+	if limit < 1 {
+		limit = 1
+	}
+	keys := map[string]struct{}{}
+	for {
+		select {
+		case key := <-r.slide.queue:
+			if len(keys) < limit {
+				keys[key] = struct{}{}
+			}
+			continue
+		case <-ticker.C:
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		ctx := context.Background()
+		pipe := r.db.Pipeline()
+		for key := range keys {
+			pipe.Expire(ctx, key, r._ttl(key))
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil && err != redis.Nil {
+			log.Println("rdb_slide_err	", err)
+		}
+		keys = map[string]struct{}{}
+	}
+}
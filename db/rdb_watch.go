@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// OnChange 在后台监督每个 master 上的 keyspace 订阅, 不阻塞调用方
+// 每 __watchInterval 重新取一次 master 列表, 新出现的 master 订阅上, 消失的取消订阅;
+// MOVED 由 ClusterClient 自己处理并刷新 slot, 下一次检查就能看到新的 master
+// 订阅断开后按 __backoffMin 到 __backoffMax 指数退避重连, 同时让 ClusterClient 刷新拓扑
+// 断开期间和拓扑变化时的通知都收不到, 每次订阅成功后调用 resync 做一次全量同步;
+// 第一次订阅也一样, 调用方的首次同步和订阅生效之间的通知同样会丢
+
+const (
+	__watchInterval = time.Second * 5
+	__watchPing     = time.Second * 30 //这么久没有消息就 PING 一次, 检查连接还活着
+	__backoffMin    = time.Millisecond * 100
+	__backoffMax    = time.Second * 30
+)
+
+type rdbWatch struct {
+	cb     func(op, key string)
+	resync chan struct{}
+	kick   chan struct{}
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc //master 地址 -> 取消订阅
+}
+
+// OnChange cb 会在多个 goroutine 里并发调用; resync 可以为 nil, 多次缺口合并成一次调用
+func (r *Rdb) OnChange(cb func(op, key string), resync func()) {
+
+	w := &rdbWatch{
+		cb:     cb,
+		resync: make(chan struct{}, 1),
+		kick:   make(chan struct{}, 1),
+		subs:   map[string]context.CancelFunc{},
+	}
+	go w._resyncer(resync)
+	go r._watch(w)
+}
+
+func (w *rdbWatch) _resyncer(resync func()) {
+
+	for range w.resync {
+		if resync != nil {
+			resync()
+		}
+	}
+}
+
+// _gap 通知可能丢了, 正在同步时再排一次
+func (w *rdbWatch) _gap() {
+
+	select {
+	case w.resync <- struct{}{}:
+	default:
+	}
+}
+
+func (w *rdbWatch) _kick() {
+
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Rdb) _watch(w *rdbWatch) {
+
+	ticker := time.NewTicker(__watchInterval)
+	defer ticker.Stop()
+
+	first := true
+	for {
+		err := r._discover(w, first)
+		if err != nil {
+			log.Println("rdb_watch_err	", err)
+		} else {
+			first = false
+		}
+		select {
+		case <-ticker.C:
+		case <-w.kick:
+		}
+	}
+}
+
+// _discover 对比当前的 master 和已有的订阅, first 只影响日志
+func (r *Rdb) _discover(w *rdbWatch, first bool) error {
+
+	ctx := context.Background()
+	var mu sync.Mutex
+	masters := map[string]*redis.Client{}
+	err := r.db.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		mu.Lock()
+		masters[client.Options().Addr] = client
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for addr, cancel := range w.subs {
+		if _, ok := masters[addr]; ok {
+			continue
+		}
+		log.Println("rdb_watch_del	", addr)
+		cancel()
+		delete(w.subs, addr)
+		w._gap() //迁走的 slot 可能有没收到的通知
+	}
+	for addr, client := range masters {
+		if _, ok := w.subs[addr]; ok {
+			continue
+		}
+		if !first {
+			log.Println("rdb_watch_add	", addr)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w.subs[addr] = cancel
+		go r._subscribe(ctx, w, client)
+	}
+	return nil
+}
+
+func (r *Rdb) _subscribe(ctx context.Context, w *rdbWatch, client *redis.Client) {
+
+	addr := client.Options().Addr
+	backoff := __backoffMin
+	for {
+		subscribed, err := r._listen(ctx, w, client)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("rdb_sub_err	", addr, err)
+		if subscribed {
+			backoff = __backoffMin
+		}
+		r.db.ReloadState(ctx) //可能发生了故障转移
+		w._kick()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > __backoffMax {
+			backoff = __backoffMax
+		}
+	}
+}
+
+// _listen 订阅成功后一直收消息, 直到连接出错或者 ctx 取消; 返回是否订阅成功过
+// 订阅生效前的通知收不到, 订阅成功后排一次 resync, 多个 master 同时订阅时会合并
+func (r *Rdb) _listen(ctx context.Context, w *rdbWatch, client *redis.Client) (bool, error) {
+
+	_, err := client.ConfigSet(ctx, __notify, __events).Result()
+	if err != nil {
+		return false, err
+	}
+	sub := client.PSubscribe(ctx, r.topic)
+	defer sub.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close() //打断阻塞中的 Receive
+		case <-stop:
+		}
+	}()
+
+	_, err = sub.Receive(ctx)
+	if err != nil {
+		return false, err
+	}
+	w._gap()
+
+	for {
+		msg, err := sub.ReceiveTimeout(ctx, __watchPing)
+		if err != nil {
+			if ctx.Err() != nil {
+				return true, ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				err = sub.Ping(ctx)
+				if err == nil {
+					continue
+				}
+			}
+			return true, err
+		}
+		m, ok := msg.(*redis.Message)
+		if !ok {
+			continue
+		}
+		keys := strings.Split(m.Channel, __topic)
+		if len(keys) != 2 {
+			continue
+		}
+		w.cb(m.Payload, keys[1])
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"zcache/db"
+)
+
+// 热点 key: Get 时采样进 db.HotKeys, 成为热点的对象编码后放进进程内的 db.Local,
+// TTL 很短, 过期后重新从下一层读, 既不会长时间读到旧值, 也不会每次都打到同一个 Redis 分片
+// 指标发布在 expvar 的 zcache.<rootKey>.hot (计数) 和 zcache.<rootKey>.hot_keys (当前热点)
+
+const (
+	__hotTTL   = time.Second
+	__hotBytes = 16 << 20
+)
+
+// hotKeys rootKey => *db.HotKeys, expvar 每个名字只能发布一次, 发布的函数从这里取最后创建的实例
+var hotKeys sync.Map
+
+type obj3Hot struct {
+	keys  *db.HotKeys
+	local *db.Local
+	ttl   time.Duration
+	codec db.JSONCodec
+	stats *expvar.Map
+}
+
+func newObj3Hot(rootKey string, opts Obj3Options) *obj3Hot {
+
+	if opts.HotTTL < 0 {
+		return nil
+	}
+	if opts.HotTTL == 0 {
+		opts.HotTTL = __hotTTL
+	}
+	hot := &obj3Hot{
+		keys: db.NewHotKeys(opts.Hot),
+		local: db.NewLocalWithOptions(db.LocalOptions{
+			MaxBytes: __hotBytes,
+			MaxStale: opts.HotTTL,
+		}),
+		ttl: opts.HotTTL,
+	}
+
+	name := "zcache." + rootKey + ".hot"
+	stats, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		stats = expvar.NewMap(name)
+	}
+	hot.stats = stats
+	hotKeys.Store(rootKey, hot.keys)
+	if expvar.Get(name+"_keys") == nil {
+		expvar.Publish(name+"_keys", expvar.Func(func() interface{} {
+			keys, _ := hotKeys.Load(rootKey)
+			return keys.(*db.HotKeys).Top()
+		}))
+	}
+	return hot
+}
+
+// _getHot 采样一次 key, 是热点时先查进程内的副本; 返回 key 是不是热点和有没有命中
+func (oc *Obj3Cache) _getHot(key string, info interface{}) (bool, bool) {
+
+	if oc.hot == nil {
+		return false, false
+	}
+	oc.hot.stats.Add("gets", 1)
+	if !oc.hot.keys.Add(key) {
+		return false, false
+	}
+	data, ok := oc.hot.local.AppendValue(nil, key)
+	if !ok || oc.hot.codec.Unmarshal(data, info) != nil {
+		return true, false
+	}
+	oc.hot.stats.Add("hits", 1)
+	return true, true
+}
+
+func (oc *Obj3Cache) _pin(key string, info interface{}) {
+
+	data, err := oc.hot.codec.Marshal(info)
+	if err != nil {
+		return
+	}
+	if oc.hot.local.SetEx(key, data, oc.hot.ttl) == nil {
+		oc.hot.stats.Add("pins", 1)
+	}
+}
+
+func (oc *Obj3Cache) _unpin(key string) {
+
+	if oc.hot != nil {
+		oc.hot.local.Del(key)
+	}
+}
+
+// HotKeys 返回当前的热点 key, 按采样计数从大到小
+func (oc *Obj3Cache) HotKeys() []db.HotKey {
+
+	if oc.hot == nil {
+		return nil
+	}
+	return oc.hot.keys.Top()
+}
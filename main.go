@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"time"
 	"zcache/db"
 	"zcache/utils"
 
@@ -13,14 +14,38 @@ type Obj3Cache struct {
 	rdb     *db.Rdb
 	mdb     *db.Mdb
 	ldb     *db.Ldb
+	warm    bool // owner 收到 hset 时从 Redis 回填 Ldb, 给只读的 worker 用
+	hot     *obj3Hot
+	reject  bool
 }
 
+type Obj3Options struct {
+	Rdb db.RdbOptions
+	// ReadOnly 由构造函数决定, Limits 见下面
+	// MaxBytes 和 MaxEntries 都为 0 时用 MaxSize 的一半做容量预算, 默认 512m; 设成 <0 不淘汰
+	Ldb db.LdbOptions
+	Hot db.HotOptions
+	// 热点对象在进程内缓存多久, 0 时用 __hotTTL, <0 不检测热点
+	HotTTL time.Duration
+
+	// Rdb 和 Ldb 共用的大小限制, 设置了时覆盖 Rdb.Limits 和 Ldb.Limits; 超出的对象不进缓存, 每次都从 Mdb 读
+	Limits db.Limits
+	// 超出限制的 Set, Getset 直接返回 db.ErrTooLarge, 不写 Mdb
+	RejectOversize bool
+}
+
+const (
+	__ldbMaxSize = 1024 * 1024 * 1024 //和 Ldb 默认的 MaxSize 一致
+)
+
 var opMap = map[string]struct{}{
-	"expired": {},
-	"del":     {},
-	"hset":    {},
-	"hdel":    {},
-	"hincrby": {},
+	"expired":      {},
+	"del":          {},
+	"hset":         {},
+	"set":          {},
+	"hdel":         {},
+	"hincrby":      {},
+	"hincrbyfloat": {},
 }
 
 //
@@ -34,31 +59,129 @@ func NewObj3Cache(
 	client *redis.ClusterClient,
 ) *Obj3Cache {
 
-	tmpDir := utils.GetTempDir()
+	return NewObj3CacheWithOptions(rootKey, mgo, client, Obj3Options{})
+}
 
-	obj3Cache := &Obj3Cache{
-		mdb: db.NewMdb(rootKey, mgo),
-		rdb: db.NewRdb(rootKey, client),
-		ldb: db.NewLdb(rootKey, tmpDir, 0),
-	}
+func NewObj3CacheWithOptions(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+	opts Obj3Options,
+) *Obj3Cache {
 
+	obj3Cache := _newObj3Cache(rootKey, mgo, client, opts, false)
 	obj3Cache._initSync()
 	obj3Cache._onSync()
 
 	return obj3Cache
 }
 
+// NewObj3CacheOwner 同一台机器上唯一写 Ldb 的进程, 处理失效通知,
+// 并把 worker 写回 Redis 的对象回填到共享的 Ldb
+func NewObj3CacheOwner(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+) *Obj3Cache {
+
+	return NewObj3CacheOwnerWithOptions(rootKey, mgo, client, Obj3Options{})
+}
+
+// NewObj3CacheOwnerWithOptions opts 要和 worker 的一致, 特别是 Rdb.BlobTables
+func NewObj3CacheOwnerWithOptions(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+	opts Obj3Options,
+) *Obj3Cache {
+
+	obj3Cache := NewObj3CacheWithOptions(rootKey, mgo, client, opts)
+	obj3Cache.warm = true
+	return obj3Cache
+}
+
+// NewObj3CacheWorker 只读打开 owner 的 Ldb, 不订阅 Redis
+func NewObj3CacheWorker(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+) *Obj3Cache {
+
+	return NewObj3CacheWorkerWithOptions(rootKey, mgo, client, Obj3Options{})
+}
+
+func NewObj3CacheWorkerWithOptions(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+	opts Obj3Options,
+) *Obj3Cache {
+
+	return _newObj3Cache(rootKey, mgo, client, opts, true)
+}
+
+func _newObj3Cache(
+	rootKey string,
+	mgo *qmgo.Client,
+	client *redis.ClusterClient,
+	opts Obj3Options,
+	readOnly bool,
+) *Obj3Cache {
+
+	tmpDir := utils.GetTempDir()
+	if opts.Limits.Enabled() {
+		opts.Rdb.Limits = opts.Limits
+		opts.Ldb.Limits = opts.Limits
+	}
+	opts.Ldb.ReadOnly = readOnly
+	if opts.Ldb.MaxBytes == 0 && opts.Ldb.MaxEntries == 0 {
+		maxSize := opts.Ldb.MaxSize
+		if maxSize <= 0 {
+			maxSize = __ldbMaxSize
+		}
+		opts.Ldb.MaxBytes = maxSize / 2 //留出 meta 和页的开销
+	}
+
+	return &Obj3Cache{
+		rootKey: rootKey,
+		mdb:     db.NewMdb(rootKey, mgo),
+		rdb:     db.NewRdbWithOptions(rootKey, client, opts.Rdb),
+		ldb:     db.NewLdbWithOptions(rootKey, tmpDir, opts.Ldb),
+		hot:     newObj3Hot(rootKey, opts),
+		reject:  opts.RejectOversize,
+	}
+}
+
 func (oc *Obj3Cache) _onSync() {
 
 	oc.rdb.OnChange(func(op, key string) {
-		_, ok := opMap[key]
+		_, ok := opMap[op]
 		if !ok {
 			return
 		}
 		oc.ldb.Del(key, "")
+		oc._unpin(key)
+		if oc.warm && op == "hset" {
+			oc._warm(key)
+		}
+	}, func() {
+		oc._initSync()
 	})
 }
 
+func (oc *Obj3Cache) _warm(key string) {
+
+	data, err := oc.rdb.GetAll(key)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	out := make(map[string]interface{}, len(data))
+	for field, value := range data {
+		out[field] = value
+	}
+	oc.ldb.Set(key, out)
+}
+
 func (oc *Obj3Cache) _initSync() error {
 
 	allKeys := oc.ldb.GetAllKeys()
@@ -75,33 +198,49 @@ func (oc *Obj3Cache) _initSync() error {
 	return nil
 }
 
-func (oc *Obj3Cache) _getInfo(info interface{}) (string, map[string]interface{}, error) {
+// _getInfo 返回的 out 不含主键 field, 主键见 utils.GetKey
+func (oc *Obj3Cache) _getInfo(info interface{}) (utils.ObjKey, map[string]interface{}, error) {
 
 	out, err := utils.Struct2Map("redis", info)
 	if err != nil {
-		return "", nil, err
+		return utils.ObjKey{}, nil, err
 	}
-	id, _ := out["id"].(string)
-	delete(out, "id")
+	id := utils.GetKey(info, out)
 
 	return id, out, nil
 }
 
-func (oc *Obj3Cache) _getKey(id string, info interface{}) (string, string) {
+func (oc *Obj3Cache) _getKey(id utils.ObjKey, info interface{}) (string, string) {
 
 	table := utils.GetTable(info)
-	key := utils.Sprintf(oc.rootKey, "/", table, "/", id)
+	key := utils.Sprintf(oc.rootKey, "/", table, "/", id.String())
 	return table, key
 }
 
+// _checkLimit RejectOversize 时检查, blob 模式的 table 按编码后的大小算, 和 SetBlob 一致
+func (oc *Obj3Cache) _checkLimit(table, key string, info interface{}, out map[string]interface{}) error {
+
+	if !oc.reject {
+		return nil
+	}
+	if oc.rdb.IsBlob(table) {
+		return oc.rdb.CheckBlobLimit(key, info)
+	}
+	return oc.rdb.CheckLimit(key, out)
+}
+
 func (oc Obj3Cache) Set(info struct{}) error {
 
 	id, out, err := oc._getInfo(info)
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
+	err = oc._checkLimit(table, key, info, out)
+	if err != nil {
+		return err
+	}
 	err = oc.mdb.Set(table, id, out)
 	if err != nil {
 		return err
@@ -117,21 +256,50 @@ func (oc *Obj3Cache) Get(info interface{}) error {
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
-	err = oc.ldb.Get(key, info, out)
-	if err == nil {
+	hot, ok := oc._getHot(key, info)
+	if ok {
 		return nil
 	}
-	err = oc.rdb.Get(key, info)
+	// blob 模式的 table 不进 Ldb, Ldb 按 field 存, 放不下嵌套的对象
+	blob := oc.rdb.IsBlob(table)
+	if !blob {
+		err = oc.ldb.Get(key, info, out)
+		if err == nil {
+			if hot {
+				oc._pin(key, info)
+			}
+			return nil
+		}
+	}
+	if blob {
+		err = oc.rdb.GetBlob(key, info)
+	} else {
+		err = oc.rdb.Get(key, info)
+	}
 	if err == nil {
-		oc.ldb.Set(key, out)
+		if hot {
+			oc._pin(key, info)
+		}
+		if !blob && !oc.ldb.ReadOnly() {
+			_, out, _ = oc._getInfo(info)
+			oc.ldb.Set(key, out)
+		}
 		return nil
 	}
 	err = oc.mdb.Get(table, id, info)
 	if err != nil {
 		return nil
 	}
+	if hot {
+		oc._pin(key, info)
+	}
+	if blob {
+		oc.rdb.SetBlob(key, info)
+		return nil
+	}
+	_, out, _ = oc._getInfo(info)
 	oc.rdb.Set(key, out)
 
 	return nil
@@ -143,7 +311,7 @@ func (oc *Obj3Cache) Del(info interface{}) error {
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
 	err = oc.mdb.Del(table, id)
 	if err != nil {
@@ -161,7 +329,7 @@ func (oc *Obj3Cache) IncrBy(info interface{}) error {
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
 	newOut := map[string]interface{}{}
 	for field, value := range out {
@@ -187,8 +355,12 @@ func (oc *Obj3Cache) Getset(info interface{}) error {
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
+	err = oc._checkLimit(table, key, info, out)
+	if err != nil {
+		return err
+	}
 	err = oc.mdb.Getset(table, id, info, out)
 	if err != nil {
 		return err
@@ -204,7 +376,7 @@ func (oc *Obj3Cache) DelField(info interface{}) error {
 	if err != nil {
 		return err
 	}
-	key, table := oc._getKey(id, info)
+	table, key := oc._getKey(id, info)
 
 	err = oc.mdb.DelField(table, id, out)
 	if err != nil {
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 对象的主键默认是 redis tag 为 id 的 field, 也可以用 zcache:"key" 标出一个或多个 field,
+// 多个时按声明顺序组成联合主键, 例如:
+//
+//	type Follow struct {
+//		UserId int64  `redis:"userId" zcache:"key"`
+//		Target int64  `redis:"target" zcache:"key"`
+//		Note   string `redis:"note"`
+//	}
+//
+// 主键的值可以是 string, 整数或者 ObjectID, String 转成缓存 key 里用的规范字符串
+
+const (
+	__keyTag  = "zcache"
+	__keySep  = ":"
+	__defKey  = "id"
+	__keyName = "key"
+)
+
+type ObjKey struct {
+	Fields []string //redis tag 名, 也是 Mongo 里的字段名
+	Values []interface{}
+}
+
+var keyFields sync.Map //reflect.Type => []string
+
+// GetKeyFields 返回 dest 的主键 field 名, 按类型缓存
+func GetKeyFields(dest interface{}) []string {
+
+	modelType := reflect.ValueOf(dest).Type()
+	for modelType.Kind() == reflect.Slice || modelType.Kind() == reflect.Array || modelType.Kind() == reflect.Ptr {
+		modelType = modelType.Elem()
+	}
+	if fields, ok := keyFields.Load(modelType); ok {
+		return fields.([]string)
+	}
+
+	fields := []string{}
+	if modelType.Kind() == reflect.Struct {
+		for i := 0; i < modelType.NumField(); i++ {
+			field := modelType.Field(i)
+			if field.Tag.Get(__keyTag) != __keyName {
+				continue
+			}
+			fields = append(fields, _tagName(field))
+		}
+	}
+	if len(fields) == 0 {
+		fields = append(fields, __defKey)
+	}
+	keyFields.Store(modelType, fields)
+	return fields
+}
+
+// _tagName 和 mapstructure 一样, 没有 tag 时用 field 名
+func _tagName(field reflect.StructField) string {
+
+	name := strings.Split(field.Tag.Get("redis"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// GetKey 从 Struct2Map 的结果里取出主键, 并把主键 field 从 out 里删掉
+func GetKey(info interface{}, out map[string]interface{}) ObjKey {
+
+	fields := GetKeyFields(info)
+	key := ObjKey{
+		Fields: fields,
+		Values: make([]interface{}, len(fields)),
+	}
+	for i, field := range fields {
+		key.Values[i] = out[field]
+		delete(out, field)
+	}
+	return key
+}
+
+// String 单个主键直接用值的字符串, 联合主键用 : 连接, 每一段里的 % 和 : 转义
+func (k ObjKey) String() string {
+
+	if len(k.Values) == 1 {
+		return KeyString(k.Values[0])
+	}
+	parts := make([]string, len(k.Values))
+	for i, v := range k.Values {
+		s := KeyString(v)
+		s = strings.ReplaceAll(s, "%", "%25")
+		parts[i] = strings.ReplaceAll(s, __keySep, "%3A")
+	}
+	return strings.Join(parts, __keySep)
+}
+
+// KeyString 主键值的规范字符串: 整数用十进制, ObjectID 用 hex
+func KeyString(v interface{}) string {
+
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case interface{ Hex() string }:
+		return v.Hex()
+	default:
+		return string(WriteArg(v))
+	}
+}
@@ -81,6 +81,7 @@ func Scan(b []byte, v interface{}) (interface{}, error) {
 	return val, err
 }
 
+// ToNumber 只接受整数类型
 func ToNumber(v interface{}) (int64, bool) {
 	switch v := v.(type) {
 	case int:
@@ -103,13 +104,28 @@ func ToNumber(v interface{}) (int64, bool) {
 		return int64(v), true
 	case uint64:
 		return int64(v), true
+	default: //浮点数不截断, 用 ToFloat
+		return 0, false
+	}
+}
+
+func ToFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
 	case float32:
-		return int64(v), true
+		return float64(v), true
 	case float64:
-		return int64(v), true
-	default:
-		return 0, false
+		return v, true
+	}
+	n, ok := ToNumber(v)
+	return float64(n), ok
+}
+
+func IsFloat(v interface{}) bool {
+	switch v.(type) {
+	case float32, float64:
+		return true
 	}
+	return false
 }
 
 var numKindMap = map[reflect.Kind]struct{}{